@@ -0,0 +1,54 @@
+package bundle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version of the archive format. Archives of a later version are refused.
+const Version = 1
+
+const manifestFile = "manifest.json"
+
+var (
+	ErrUnsupported    = errors.New("archive was made by a newer version")
+	ErrCorrupted      = errors.New("archive is corrupted")
+	ErrConflict       = errors.New("records of the archive conflict with existing ones")
+	ErrNotProvisioned = errors.New("brand database isn't provisioned")
+)
+
+// Manifest describes an archive. It is written last, once the checksums
+// are known.
+type Manifest struct {
+	Version    int       `json:"version"`
+	Brand      string    `json:"brand"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// SchemaVersion is the last brand migration the database had applied;
+	// Migrations lists all of them.
+	SchemaVersion string       `json:"schemaVersion"`
+	Migrations    []string     `json:"migrations"`
+	Collections   []Collection `json:"collections"`
+}
+
+// Collection is stored as one document per line, in canonical extended
+// JSON so types survive the round trip.
+type Collection struct {
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	Documents int64  `json:"documents"`
+	// SHA256 of the file, hex encoded.
+	SHA256 string `json:"sha256"`
+}
+
+// FileName is the name archives of the brand are given.
+func FileName(slug string, at time.Time) string {
+	return fmt.Sprintf("%s-%s.zip", slug, at.UTC().Format("20060102-150405"))
+}
+
+// exported tells whether the collection belongs in archives. The migration
+// ledger is described by the manifest instead.
+func exported(name string) bool {
+	return name != "migrations" && !strings.HasPrefix(name, "system.")
+}
@@ -0,0 +1,113 @@
+package bundle
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"slices"
+	"time"
+	"white-label-crm/migrations"
+)
+
+// Export streams every collection of the brand database to w as a zip
+// archive. Trashed records are included. Writes made during the export may
+// or may not be, so suspend the brand first for a consistent archive.
+func Export(ctx context.Context, db *mongo.Database, slug string, w io.Writer) (*Manifest, error) {
+	status, err := migrations.Status(ctx, db, migrations.ScopeBrand)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Version:    Version,
+		Brand:      slug,
+		ExportedAt: time.Now().UTC(),
+		Migrations: []string{},
+	}
+
+	for _, entry := range status {
+		if entry.Applied {
+			manifest.Migrations = append(manifest.Migrations, entry.ID)
+			manifest.SchemaVersion = entry.ID
+		}
+	}
+
+	names, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		if !exported(name) {
+			continue
+		}
+
+		collection, err := exportCollection(ctx, db.Collection(name), archive)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Collections = append(manifest.Collections, collection)
+	}
+
+	file, err := archive.Create(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, archive.Close()
+}
+
+func exportCollection(ctx context.Context, collection *mongo.Collection, archive *zip.Writer) (Collection, error) {
+	entry := Collection{
+		Name: collection.Name(),
+		File: "collections/" + collection.Name() + ".ndjson",
+	}
+
+	file, err := archive.Create(entry.File)
+	if err != nil {
+		return entry, err
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return entry, err
+	}
+	defer cursor.Close(ctx)
+
+	checksum := sha256.New()
+	out := io.MultiWriter(file, checksum)
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return entry, err
+		}
+
+		if _, err := out.Write(append(line, '\n')); err != nil {
+			return entry, err
+		}
+
+		entry.Documents++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return entry, err
+	}
+
+	entry.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	return entry, nil
+}
@@ -0,0 +1,508 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/migrations"
+	"white-label-crm/redis"
+)
+
+// ConflictPolicy decides what happens to an archived record that already
+// exists in the brand, by id or by one of its unique fields.
+type ConflictPolicy string
+
+const (
+	// ConflictFail refuses the import when any record conflicts, before
+	// anything is written.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictSkip keeps the existing record. References to the archived
+	// one are pointed at it.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictOverwrite replaces the existing record with the archived one,
+	// keeping the id of the existing record.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+)
+
+func (p ConflictPolicy) Valid() bool {
+	return slices.Contains([]ConflictPolicy{ConflictFail, ConflictSkip, ConflictOverwrite}, p)
+}
+
+const (
+	lockTTL   = time.Hour
+	batchSize = 1000
+	// A document is at most 16MB, which takes more as extended JSON.
+	maxLineSize = 64 << 20
+)
+
+type ImportOptions struct {
+	Conflict ConflictPolicy
+	// RemapIDs gives every imported record a new id and rewrites the
+	// references to it. Records then only conflict through their unique
+	// fields, so an archive can be imported next to the data it came from.
+	RemapIDs bool
+	// DryRun checks the archive and reports what would be imported.
+	DryRun bool
+}
+
+type ImportReport struct {
+	Brand         string              `json:"brand"`
+	SchemaVersion string              `json:"schemaVersion"`
+	Collections   []*CollectionReport `json:"collections"`
+	// Replayed are the migrations of the brand that the archive predates,
+	// run again over the imported records.
+	Replayed []string `json:"replayed"`
+}
+
+type CollectionReport struct {
+	Name     string `json:"name"`
+	Inserted int64  `json:"inserted"`
+	Replaced int64  `json:"replaced"`
+	Skipped  int64  `json:"skipped"`
+	// Conflicts are the ids of the archived records that conflicted.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+type action int
+
+const (
+	insert action = iota
+	replace
+	skip
+)
+
+// decision is what happens to an archived record, and the id it ends up
+// with.
+type decision struct {
+	action action
+	id     interface{}
+}
+
+// Import restores an archive made by Export into a provisioned brand
+// database. The archive is checked whole before anything is written: its
+// version, that this version knows its migrations, and its checksums.
+// Migrations the brand has but the archive predates are replayed once the
+// records are in. ErrConflict is returned, along with the report listing
+// them, when records conflict under ConflictFail.
+func Import(ctx context.Context, archive io.ReaderAt, size int64, db *mongo.Database, opts ImportOptions) (*ImportReport, error) {
+	if !opts.Conflict.Valid() {
+		return nil, fmt.Errorf("unknown conflict policy %q", opts.Conflict)
+	}
+
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	manifest, err := readManifest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	replay, err := pendingReplay(ctx, db, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		lock, err := redis.Acquire(ctx, fmt.Sprintf("locks:import:%s", db.Name()), lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := lock.Release(context.Background()); err != nil {
+				log.Printf("[bundle.Import] %v\n", err)
+			}
+		}()
+	}
+
+	report := &ImportReport{
+		Brand:         manifest.Brand,
+		SchemaVersion: manifest.SchemaVersion,
+		Replayed:      replay,
+	}
+
+	// Decide the fate of every record first, so references can be
+	// rewritten whichever collection they point into.
+	decisions := map[string]decision{}
+	ids := map[primitive.ObjectID]primitive.ObjectID{}
+	conflicts := false
+	for _, collection := range manifest.Collections {
+		collectionReport := &CollectionReport{Name: collection.Name}
+		report.Collections = append(report.Collections, collectionReport)
+
+		uniques := uniqueFields(collection.Name)
+		err := eachDocument(reader, collection, func(doc bson.D) error {
+			id := lookup(doc, "_id")
+			// Only object ids are remapped, other ids are kept as they are.
+			_, remapped := id.(primitive.ObjectID)
+			remapped = remapped && opts.RemapIDs
+
+			existing, err := findExisting(ctx, db.Collection(collection.Name), doc, uniques, !remapped)
+			if err != nil {
+				return err
+			}
+
+			d := decision{action: insert, id: id}
+			if existing != nil {
+				collectionReport.Conflicts = append(collectionReport.Conflicts, fmt.Sprint(id))
+				conflicts = true
+
+				d.id = existing
+				if opts.Conflict == ConflictSkip {
+					d.action = skip
+					collectionReport.Skipped++
+				} else {
+					d.action = replace
+					collectionReport.Replaced++
+				}
+			} else {
+				if remapped {
+					d.id = primitive.NewObjectID()
+				}
+
+				collectionReport.Inserted++
+			}
+
+			if oid, ok := id.(primitive.ObjectID); ok {
+				if newID, ok := d.id.(primitive.ObjectID); ok {
+					ids[oid] = newID
+				}
+			}
+
+			decisions[decisionKey(collection.Name, id)] = d
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", collection.Name, err)
+		}
+	}
+
+	if conflicts && opts.Conflict == ConflictFail {
+		return report, ErrConflict
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, collection := range manifest.Collections {
+		if err := restoreCollection(ctx, reader, collection, db.Collection(collection.Name), decisions, ids); err != nil {
+			return report, fmt.Errorf("%s: %w", collection.Name, err)
+		}
+	}
+
+	if len(replay) > 0 {
+		if _, err := migrations.Replay(ctx, db, migrations.ScopeBrand, replay, migrations.Options{}); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// readManifest reads the manifest and checks the archive against it.
+func readManifest(reader *zip.Reader) (*Manifest, error) {
+	file, err := reader.Open(manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	defer file.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	if manifest.Version > Version {
+		return nil, fmt.Errorf("%w: format version %d", ErrUnsupported, manifest.Version)
+	}
+
+	known := map[string]bool{}
+	for _, m := range migrations.All(migrations.ScopeBrand) {
+		known[m.ID] = true
+	}
+
+	for _, id := range manifest.Migrations {
+		if !known[id] {
+			return nil, fmt.Errorf("%w: unknown migration %s", ErrUnsupported, id)
+		}
+	}
+
+	for _, collection := range manifest.Collections {
+		if !exported(collection.Name) {
+			return nil, fmt.Errorf("%w: collection %s can't be imported", ErrCorrupted, collection.Name)
+		}
+
+		file, err := reader.Open(collection.File)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+
+		checksum := sha256.New()
+		_, err = io.Copy(checksum, file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+
+		if hex.EncodeToString(checksum.Sum(nil)) != collection.SHA256 {
+			return nil, fmt.Errorf("%w: checksum of %s doesn't match", ErrCorrupted, collection.File)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// pendingReplay returns the migrations the brand has applied that the
+// archive predates.
+func pendingReplay(ctx context.Context, db *mongo.Database, manifest *Manifest) ([]string, error) {
+	status, err := migrations.Status(ctx, db, migrations.ScopeBrand)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := []string{}
+	provisioned := false
+	for _, entry := range status {
+		if !entry.Applied {
+			continue
+		}
+
+		provisioned = true
+		if !slices.Contains(manifest.Migrations, entry.ID) {
+			replay = append(replay, entry.ID)
+		}
+	}
+
+	if !provisioned {
+		return nil, ErrNotProvisioned
+	}
+
+	return replay, nil
+}
+
+// uniqueFields lists the fields of each unique index of the collection, as
+// declared by its model.
+func uniqueFields(collection string) [][]string {
+	var uniques [][]string
+	for _, model := range models.BrandModels() {
+		if model.GetCollectionName() != collection {
+			continue
+		}
+
+		for _, index := range model.Indexes() {
+			if !index.Unique {
+				continue
+			}
+
+			var fields []string
+			for _, key := range index.Keys {
+				fields = append(fields, key.Key)
+			}
+
+			uniques = append(uniques, fields)
+		}
+	}
+
+	return uniques
+}
+
+// findExisting returns the id of the record the archived document
+// conflicts with, or nil.
+func findExisting(ctx context.Context, collection *mongo.Collection, doc bson.D, uniques [][]string, byID bool) (interface{}, error) {
+	for _, filter := range existingFilters(doc, uniques, byID) {
+		var existing struct {
+			ID interface{} `bson:"_id"`
+		}
+
+		err := collection.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return existing.ID, nil
+	}
+
+	return nil, nil
+}
+
+// existingFilters match the records the archived document would conflict
+// with: the one with its id, then one per unique index.
+func existingFilters(doc bson.D, uniques [][]string, byID bool) []bson.M {
+	filters := []bson.M{}
+	if byID {
+		filters = append(filters, bson.M{"_id": lookup(doc, "_id")})
+	}
+
+	for _, fields := range uniques {
+		filter := bson.M{}
+		for _, field := range fields {
+			value := lookup(doc, field)
+			if value == nil {
+				// Unique indexes see a missing field as null.
+				filter[field] = nil
+				continue
+			}
+
+			filter[field] = value
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters
+}
+
+func restoreCollection(
+	ctx context.Context,
+	reader *zip.Reader,
+	entry Collection,
+	collection *mongo.Collection,
+	decisions map[string]decision,
+	ids map[primitive.ObjectID]primitive.ObjectID,
+) error {
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		_, err := collection.InsertMany(ctx, batch)
+		batch = batch[:0]
+		return err
+	}
+
+	err := eachDocument(reader, entry, func(doc bson.D) error {
+		d := decisions[decisionKey(entry.Name, lookup(doc, "_id"))]
+		if d.action == skip {
+			return nil
+		}
+
+		doc = remap(doc, ids).(bson.D)
+		doc = setID(doc, d.id)
+
+		if d.action == replace {
+			_, err := collection.ReplaceOne(ctx, bson.M{"_id": d.id}, doc)
+			return err
+		}
+
+		batch = append(batch, doc)
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+func eachDocument(reader *zip.Reader, entry Collection, fn func(doc bson.D) error) error {
+	file, err := reader.Open(entry.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+	for scanner.Scan() {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// remap rewrites every object id of the value that belongs to a remapped
+// record. Object ids are unique, so any match is a reference.
+func remap(value interface{}, ids map[primitive.ObjectID]primitive.ObjectID) interface{} {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		if newID, ok := ids[v]; ok {
+			return newID
+		}
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			out[i] = bson.E{Key: e.Key, Value: remap(e.Value, ids)}
+		}
+
+		return out
+	case bson.A:
+		out := make(bson.A, len(v))
+		for i, item := range v {
+			out[i] = remap(item, ids)
+		}
+
+		return out
+	}
+
+	return value
+}
+
+// lookup returns the value of a dotted field of the document, or nil.
+func lookup(doc bson.D, field string) interface{} {
+	key, rest, nested := strings.Cut(field, ".")
+	for _, e := range doc {
+		if e.Key != key {
+			continue
+		}
+
+		if !nested {
+			return e.Value
+		}
+
+		if sub, ok := e.Value.(bson.D); ok {
+			return lookup(sub, rest)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+func setID(doc bson.D, id interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == "_id" {
+			doc[i].Value = id
+			return doc
+		}
+	}
+
+	return append(bson.D{{Key: "_id", Value: id}}, doc...)
+}
+
+func decisionKey(collection string, id interface{}) string {
+	return fmt.Sprintf("%s/%v", collection, id)
+}
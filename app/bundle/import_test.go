@@ -0,0 +1,163 @@
+package bundle
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+)
+
+func TestRemap(t *testing.T) {
+	oldID, newID := primitive.NewObjectID(), primitive.NewObjectID()
+	other := primitive.NewObjectID()
+	ids := map[primitive.ObjectID]primitive.ObjectID{oldID: newID}
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{name: "remapped id", value: oldID, want: newID},
+		{name: "other id", value: other, want: other},
+		{name: "scalar", value: "x", want: "x"},
+		{name: "nil", value: nil, want: nil},
+		{
+			name:  "document",
+			value: bson.D{{Key: "_id", Value: oldID}, {Key: "owner", Value: other}},
+			want:  bson.D{{Key: "_id", Value: newID}, {Key: "owner", Value: other}},
+		},
+		{
+			name:  "array",
+			value: bson.A{oldID, other, "x"},
+			want:  bson.A{newID, other, "x"},
+		},
+		{
+			name:  "nested",
+			value: bson.D{{Key: "refs", Value: bson.A{bson.D{{Key: "id", Value: oldID}}}}},
+			want:  bson.D{{Key: "refs", Value: bson.A{bson.D{{Key: "id", Value: newID}}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remap(tt.value, ids); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("remap(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	// The archived document is left untouched.
+	doc := bson.D{{Key: "_id", Value: oldID}}
+	remap(doc, ids)
+	if doc[0].Value != oldID {
+		t.Errorf("remap modified its argument: %v", doc)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := bson.D{
+		{Key: "email", Value: "jane@example.com"},
+		{Key: "profile", Value: bson.D{{Key: "address", Value: bson.D{{Key: "city", Value: "Paris"}}}}},
+		{Key: "tags", Value: bson.A{"a"}},
+	}
+
+	tests := []struct {
+		field string
+		want  interface{}
+	}{
+		{field: "email", want: "jane@example.com"},
+		{field: "profile.address.city", want: "Paris"},
+		{field: "profile.address", want: bson.D{{Key: "city", Value: "Paris"}}},
+		{field: "missing", want: nil},
+		{field: "profile.missing", want: nil},
+		{field: "email.domain", want: nil},
+		{field: "tags.0", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := lookup(doc, tt.field); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookup(%q) = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistingFilters(t *testing.T) {
+	id := primitive.NewObjectID()
+	doc := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "email", Value: "jane@example.com"},
+		{Key: "name", Value: bson.D{{Key: "first", Value: "Jane"}}},
+	}
+
+	tests := []struct {
+		name    string
+		uniques [][]string
+		byID    bool
+		want    []bson.M
+	}{
+		{
+			name: "none",
+			want: []bson.M{},
+		},
+		{
+			name: "id only",
+			byID: true,
+			want: []bson.M{{"_id": id}},
+		},
+		{
+			name:    "id first, then unique indexes",
+			uniques: [][]string{{"email"}, {"name.first", "deletedAt"}},
+			byID:    true,
+			want: []bson.M{
+				{"_id": id},
+				{"email": "jane@example.com"},
+				// Unique indexes see a missing field as null.
+				{"name.first": "Jane", "deletedAt": nil},
+			},
+		},
+		{
+			name:    "remapped ids only match by unique index",
+			uniques: [][]string{{"email"}},
+			want:    []bson.M{{"email": "jane@example.com"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := existingFilters(doc, tt.uniques, tt.byID); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("existingFilters = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetID(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name string
+		doc  bson.D
+		want bson.D
+	}{
+		{
+			name: "replaces the id",
+			doc:  bson.D{{Key: "name", Value: "x"}, {Key: "_id", Value: "old"}},
+			want: bson.D{{Key: "name", Value: "x"}, {Key: "_id", Value: id}},
+		},
+		{
+			name: "adds it first",
+			doc:  bson.D{{Key: "name", Value: "x"}},
+			want: bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "x"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := setID(tt.doc, id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setID = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package clusters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/redis"
+)
+
+const (
+	lockTTL   = 5 * time.Minute
+	batchSize = 1000
+	// How long the brand is left unavailable before the last changes are
+	// copied: long enough for every instance to see it's moving, which
+	// their brand caches take up to 5s for, and for the requests already
+	// running to finish.
+	cutoverGrace = 15 * time.Second
+)
+
+var (
+	ErrSameCluster    = errors.New("brand is already on that cluster")
+	ErrTargetNotEmpty = errors.New("brand database already exists on the target cluster")
+)
+
+type MoveOptions struct {
+	// DropSource drops the brand database from the cluster it left.
+	DropSource bool
+}
+
+// Move copies the brand database to another cluster while the brand keeps
+// being used, then switches the brand over. It is only unavailable for the
+// switch, a little longer than cutoverGrace. An empty targetURI moves the
+// brand back to the shared cluster. Should the move fail, the brand stays
+// where it was; the copy on the target is left for the next attempt to
+// refuse, so drop it first.
+func Move(ctx context.Context, id primitive.ObjectID, targetURI string, opts MoveOptions) error {
+	lock, err := redis.Acquire(ctx, fmt.Sprintf("locks:move:%s", id.Hex()), lockTTL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(context.Background()); err != nil {
+			log.Printf("[clusters.Move] %v\n", err)
+		}
+	}()
+
+	brand, err := database.FindOne[models.Brand](database.GetSystemDb(), ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	var target *database.Cluster
+	if len(targetURI) > 0 {
+		encrypted, err := database.EncryptURI(targetURI)
+		if err != nil {
+			return err
+		}
+
+		clusterID, err := database.ClusterID(targetURI)
+		if err != nil {
+			return err
+		}
+
+		target = &database.Cluster{ID: clusterID, URI: encrypted}
+	}
+
+	if (target == nil && brand.DatabaseCluster() == nil) || (target != nil && target.ID == brand.Cluster) {
+		return ErrSameCluster
+	}
+
+	source, err := brand.Db()
+	if err != nil {
+		return err
+	}
+
+	destination, err := database.GetClusterDb(target, brand.DbName())
+	if err != nil {
+		return err
+	}
+
+	if err := destination.Client().Ping(ctx, nil); err != nil {
+		return fmt.Errorf("target cluster: %w", err)
+	}
+
+	existing, err := destination.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	if len(existing) > 0 {
+		return ErrTargetNotEmpty
+	}
+
+	// Opened before copying so the changes made during the copy are
+	// replayed after it.
+	stream, err := source.Watch(ctx, mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	report, err := database.EnsureIndexes(ctx, destination, models.BrandModels(), database.IndexOptions{})
+	if err != nil {
+		return err
+	}
+
+	database.LogIndexReport(report)
+	if err := errors.Join(report.Errors...); err != nil {
+		return err
+	}
+
+	names, err := source.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") {
+			continue
+		}
+
+		copied, err := copyCollection(ctx, lock, source.Collection(name), destination.Collection(name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		log.Printf("[clusters.Move] %s | Copied %d documents of %s\n", brand.Slug, copied, name)
+	}
+
+	if err := catchUp(ctx, lock, stream, destination); err != nil {
+		return err
+	}
+
+	log.Printf("[clusters.Move] %s | Switching over\n", brand.Slug)
+	brands := database.GetSystemDb().Collection(brand.GetCollectionName())
+	if _, err := brands.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"movingAt": time.Now()}}); err != nil {
+		return err
+	}
+
+	switched := false
+	defer func() {
+		if switched {
+			return
+		}
+
+		// Back in service where it was.
+		_, err := brands.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$unset": bson.M{"movingAt": ""}})
+		if err != nil {
+			log.Printf("[clusters.Move] %s | %v\n", brand.Slug, err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(cutoverGrace):
+	}
+
+	if err := catchUp(ctx, lock, stream, destination); err != nil {
+		return err
+	}
+
+	update := bson.M{
+		"$unset":       bson.M{"movingAt": ""},
+		"$currentDate": bson.M{"updatedAt": true},
+		"$inc":         bson.M{"version": 1},
+	}
+	if target == nil {
+		update["$unset"] = bson.M{"movingAt": "", "databaseUri": "", "cluster": ""}
+	} else {
+		update["$set"] = bson.M{"databaseUri": target.URI, "cluster": target.ID}
+	}
+
+	if _, err := brands.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+		return err
+	}
+
+	switched = true
+	log.Printf("[clusters.Move] %s | Moved\n", brand.Slug)
+
+	if opts.DropSource {
+		return source.Drop(ctx)
+	}
+
+	return nil
+}
+
+// copyCollection upserts every document, so copying again is harmless.
+func copyCollection(ctx context.Context, lock *redis.Lock, from *mongo.Collection, to *mongo.Collection) (int64, error) {
+	cursor, err := from.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var (
+		copied int64
+		batch  []mongo.WriteModel
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := lock.Extend(ctx, lockTTL); err != nil {
+			return err
+		}
+
+		_, err := to.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+		copied += int64(len(batch))
+		batch = batch[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		doc := bson.Raw(append([]byte(nil), cursor.Current...))
+		batch = append(
+			batch,
+			mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"_id": doc.Lookup("_id")}).
+				SetReplacement(doc).
+				SetUpsert(true),
+		)
+
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return copied, err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return copied, err
+	}
+
+	return copied, flush()
+}
+
+type change struct {
+	OperationType string `bson:"operationType"`
+	Namespace     struct {
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey  bson.Raw `bson:"documentKey"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// catchUp applies the changes of the stream to the destination until
+// there are none left.
+func catchUp(ctx context.Context, lock *redis.Lock, stream *mongo.ChangeStream, destination *mongo.Database) error {
+	applied := 0
+	for stream.TryNext(ctx) {
+		if applied%batchSize == 0 {
+			if err := lock.Extend(ctx, lockTTL); err != nil {
+				return err
+			}
+		}
+
+		var event change
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+
+		if err := apply(ctx, destination, event); err != nil {
+			return err
+		}
+
+		applied++
+	}
+
+	if err := stream.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("[clusters.catchUp] %s | Applied %d changes\n", destination.Name(), applied)
+	return nil
+}
+
+func apply(ctx context.Context, destination *mongo.Database, event change) error {
+	collection := destination.Collection(event.Namespace.Collection)
+
+	switch event.OperationType {
+	case "insert", "update", "replace":
+		// The document was deleted since; its delete event follows.
+		if event.FullDocument == nil {
+			return nil
+		}
+
+		_, err := collection.ReplaceOne(
+			ctx,
+			event.DocumentKey,
+			event.FullDocument,
+			options.Replace().SetUpsert(true),
+		)
+		return err
+	case "delete":
+		_, err := collection.DeleteOne(ctx, event.DocumentKey)
+		return err
+	}
+
+	// drop, rename, dropDatabase and invalidate can't be followed.
+	return fmt.Errorf("%s of %s during the move", event.OperationType, event.Namespace.Collection)
+}
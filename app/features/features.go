@@ -0,0 +1,162 @@
+package features
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"time"
+	"white-label-crm/app/middleware/auth"
+	"white-label-crm/app/middleware/brand"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/utils"
+)
+
+// Instances aren't told about flag changes, so keep this short.
+const localCacheTTL = 5 * time.Second
+
+var (
+	// Holds the flags by key, under the single key "flags".
+	local = utils.NewLRU[string, map[string]models.FeatureFlag](1, localCacheTTL)
+	loads singleflight.Group
+)
+
+// Enabled evaluates the flag for the brand and user of the request. Unknown
+// flags, and flags that can't be loaded, are off.
+func Enabled(ctx *fiber.Ctx, key string) bool {
+	current, ok := brand.Current(ctx)
+	if !ok {
+		return false
+	}
+
+	flags, err := load(ctx.UserContext())
+	if err != nil {
+		log.Printf("[features.Enabled] %v\n", err)
+		return false
+	}
+
+	flag, ok := flags[key]
+	if !ok {
+		return false
+	}
+
+	return flag.EnabledFor(current.Slug, subject(ctx, current))
+}
+
+// EnabledKeys lists the keys of the flags on for the request.
+func EnabledKeys(ctx *fiber.Ctx) ([]string, error) {
+	current, ok := brand.Current(ctx)
+	if !ok {
+		return []string{}, nil
+	}
+
+	flags, err := load(ctx.UserContext())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	who := subject(ctx, current)
+	for key, flag := range flags {
+		if flag.EnabledFor(current.Slug, who) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Require hides the routes behind it while the flag is off for the
+// request, as if they didn't exist.
+func Require(key string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if !Enabled(ctx, key) {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		return ctx.Next()
+	}
+}
+
+// subject is who the percentage rollout is decided for.
+func subject(ctx *fiber.Ctx, current models.Brand) string {
+	if user := auth.CurrentUser(ctx); user != nil {
+		return user.ID.Hex()
+	}
+
+	return current.ID.Hex()
+}
+
+// load returns the flags by key, from the in-process cache, then Redis,
+// then the system database while Redis is unavailable.
+func load(ctx context.Context) (map[string]models.FeatureFlag, error) {
+	if flags, ok := local.Get("flags"); ok {
+		return flags, nil
+	}
+
+	result, err, _ := loads.Do(
+		"flags",
+		func() (interface{}, error) {
+			flags, err := loadCached(ctx)
+			if err != nil {
+				log.Printf("[features.load] %v\n", err)
+			}
+
+			// An empty cache is more likely flushed than in sync with no
+			// flags at all, so Mongo has the final say. It isn't written
+			// back as that could race with the watcher; it reconciles the
+			// cache when it restarts.
+			if len(flags) == 0 {
+				flags, err = loadStored(ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			local.Set("flags", flags)
+			return flags, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(map[string]models.FeatureFlag), nil
+}
+
+func loadCached(ctx context.Context) (map[string]models.FeatureFlag, error) {
+	docs, err := database.CachedFeatureFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := map[string]models.FeatureFlag{}
+	for _, doc := range docs {
+		var flag models.FeatureFlag
+		if err := bson.UnmarshalExtJSON([]byte(doc), false, &flag); err != nil {
+			// One bad flag shouldn't turn the others off.
+			log.Printf("[features.loadCached] %v\n", err)
+			continue
+		}
+
+		flags[flag.Key] = flag
+	}
+
+	return flags, nil
+}
+
+func loadStored(ctx context.Context) (map[string]models.FeatureFlag, error) {
+	stored, err := database.Find[models.FeatureFlag](database.GetSystemDb(), ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	flags := map[string]models.FeatureFlag{}
+	for _, flag := range stored {
+		flags[flag.Key] = *flag
+	}
+
+	return flags, nil
+}
@@ -0,0 +1,413 @@
+package listing
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"white-label-crm/app/policy"
+	"white-label-crm/database"
+)
+
+const (
+	DefaultLimit = 25
+	MaxLimit     = 100
+)
+
+var filterKeyPattern = regexp.MustCompile(`^filter\[([^\[\]]+)\](?:\[([a-zA-Z]+)\])?$`)
+
+// Error is returned for malformed list parameters and should be reported
+// to the client as a 400.
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+// Params are the parsed list query-string parameters:
+//
+//	?filter[email][contains]=doe&filter[name]=John&sort=-createdAt&limit=50&after=<cursor>&count=true
+type Params struct {
+	Filter bson.M
+	Sort   []SortKey
+	Limit  int64
+	After  []interface{}
+	Before []interface{}
+	Count  bool
+}
+
+type Page[R any] struct {
+	Data  []R
+	Next  *string
+	Prev  *string
+	Total *int64
+}
+
+// Envelope is the JSON shape of a list response.
+type Envelope struct {
+	Data  interface{} `json:"data"`
+	Next  *string     `json:"next"`
+	Prev  *string     `json:"prev"`
+	Total *int64      `json:"total,omitempty"`
+}
+
+// Parse reads the list parameters from the request. Only fields that are
+// readable under the model's policy can be filtered or sorted on.
+func Parse(ctx *fiber.Ctx, p *policy.Policy, admin bool) (*Params, error) {
+	params := &Params{
+		Filter: bson.M{},
+		Limit:  DefaultLimit,
+		Count:  ctx.QueryBool("count"),
+	}
+
+	// Filters
+	var err error
+	ctx.Request().URI().QueryArgs().VisitAll(
+		func(key []byte, value []byte) {
+			if err != nil {
+				return
+			}
+
+			match := filterKeyPattern.FindStringSubmatch(string(key))
+			if match == nil {
+				return
+			}
+
+			err = params.addFilter(p, admin, match[1], match[2], string(value))
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorting, always ending with _id so the order is total.
+	if sort := ctx.Query("sort"); len(sort) > 0 {
+		for _, name := range strings.Split(sort, ",") {
+			descending := strings.HasPrefix(name, "-")
+			field, err := readableField(p, admin, strings.TrimPrefix(name, "-"))
+			if err != nil {
+				return nil, err
+			}
+
+			if field.BSON == "_id" {
+				continue
+			}
+
+			params.Sort = append(params.Sort, SortKey{Field: field.BSON, Descending: descending})
+		}
+	}
+
+	tieBreaker := SortKey{Field: "_id"}
+	if len(params.Sort) > 0 {
+		tieBreaker.Descending = params.Sort[len(params.Sort)-1].Descending
+	}
+	params.Sort = append(params.Sort, tieBreaker)
+
+	// Limit
+	if limit := ctx.Query("limit"); len(limit) > 0 {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 || n > MaxLimit {
+			return nil, &Error{Message: fmt.Sprintf("limit must be between 1 and %d", MaxLimit)}
+		}
+
+		params.Limit = n
+	}
+
+	// Cursors
+	if after := ctx.Query("after"); len(after) > 0 {
+		if params.After, err = decodeCursor(after, params.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	if before := ctx.Query("before"); len(before) > 0 {
+		if params.After != nil {
+			return nil, &Error{Message: "after and before cannot be combined"}
+		}
+
+		if params.Before, err = decodeCursor(before, params.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
+func (params *Params) addFilter(p *policy.Policy, admin bool, name string, operator string, raw string) error {
+	field, err := readableField(p, admin, name)
+	if err != nil {
+		return err
+	}
+
+	conditions, ok := params.Filter[field.BSON].(bson.M)
+	if !ok {
+		conditions = bson.M{}
+		params.Filter[field.BSON] = conditions
+	}
+
+	switch operator {
+	case "", "eq", "ne", "gt", "gte", "lt", "lte":
+		if len(operator) == 0 {
+			operator = "eq"
+		}
+
+		value, err := parseValue(field, raw)
+		if err != nil {
+			return err
+		}
+
+		conditions["$"+operator] = value
+	case "in", "nin":
+		values := bson.A{}
+		for _, part := range strings.Split(raw, ",") {
+			value, err := parseValue(field, part)
+			if err != nil {
+				return err
+			}
+
+			values = append(values, value)
+		}
+
+		conditions["$"+operator] = values
+	case "contains":
+		conditions["$regex"] = regexp.QuoteMeta(raw)
+		conditions["$options"] = "i"
+	case "startsWith":
+		conditions["$regex"] = "^" + regexp.QuoteMeta(raw)
+	case "exists":
+		exists, err := strconv.ParseBool(raw)
+		if err != nil {
+			return &Error{Message: fmt.Sprintf("invalid value for filter[%s][exists]", name)}
+		}
+
+		conditions["$exists"] = exists
+	default:
+		return &Error{Message: fmt.Sprintf("unknown filter operator %q", operator)}
+	}
+
+	return nil
+}
+
+// List runs the query described by params against the model's collection.
+func List[T any, R interface {
+	*T
+	database.CollectionModel
+}](
+	db *mongo.Database,
+	ctx context.Context,
+	filter bson.M,
+	params *Params,
+) (*Page[R], error) {
+	query := bson.M{}
+	for k, v := range filter {
+		query[k] = v
+	}
+
+	for k, v := range params.Filter {
+		query[k] = v
+	}
+
+	page := &Page[R]{}
+
+	if params.Count {
+		total, err := database.Count[R](db, ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Total = &total
+	}
+
+	// Paging backwards runs the query in reverse and flips the results.
+	backwards := params.Before != nil
+	cursor := params.After
+	if backwards {
+		cursor = params.Before
+	}
+
+	// Filters are all keyed by field, so $or is free for the keyset. Keeping
+	// it at the top level lets database.Find see any deletedAt filter.
+	if cursor != nil {
+		query["$or"] = keysetFilter(params.Sort, cursor, backwards)
+	}
+
+	sort := bson.D{}
+	for _, key := range params.Sort {
+		direction := 1
+		if key.Descending != backwards {
+			direction = -1
+		}
+
+		sort = append(sort, bson.E{Key: key.Field, Value: direction})
+	}
+
+	records, err := database.Find[T, R](
+		db,
+		ctx,
+		query,
+		options.Find().SetSort(sort).SetLimit(params.Limit+1),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := int64(len(records)) > params.Limit
+	if hasMore {
+		records = records[:params.Limit]
+	}
+
+	if backwards {
+		slices.Reverse(records)
+	}
+
+	page.Data = records
+	if len(records) == 0 {
+		return page, nil
+	}
+
+	if hasMore || backwards {
+		next, err := encodeCursor(records[len(records)-1], params.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Next = &next
+	}
+
+	if (hasMore && backwards) || params.After != nil {
+		prev, err := encodeCursor(records[0], params.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Prev = &prev
+	}
+
+	return page, nil
+}
+
+// keysetFilter matches the records that sort after (or before) the cursor:
+//
+//	k1 > v1 OR (k1 = v1 AND k2 > v2) OR ...
+func keysetFilter(sort []SortKey, values []interface{}, backwards bool) bson.A {
+	or := bson.A{}
+	for i, key := range sort {
+		condition := bson.M{}
+		for j := range i {
+			condition[sort[j].Field] = values[j]
+		}
+
+		operator := "$gt"
+		if key.Descending != backwards {
+			operator = "$lt"
+		}
+
+		condition[key.Field] = bson.M{operator: values[i]}
+		or = append(or, condition)
+	}
+
+	return or
+}
+
+type cursorData struct {
+	Fields []string      `bson:"f"`
+	Values []interface{} `bson:"v"`
+}
+
+func encodeCursor(record interface{}, sort []SortKey) (string, error) {
+	raw, err := bson.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return "", err
+	}
+
+	data := cursorData{}
+	for _, key := range sort {
+		data.Fields = append(data.Fields, key.Field)
+		data.Values = append(data.Values, doc[key.Field])
+	}
+
+	out, err := bson.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+func decodeCursor(cursor string, sort []SortKey) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, &Error{Message: "invalid cursor"}
+	}
+
+	var data cursorData
+	if err := bson.Unmarshal(raw, &data); err != nil {
+		return nil, &Error{Message: "invalid cursor"}
+	}
+
+	// A cursor is only valid for the sort order it was created with.
+	if len(data.Fields) != len(sort) || len(data.Values) != len(sort) {
+		return nil, &Error{Message: "cursor does not match sort"}
+	}
+
+	for i, key := range sort {
+		if data.Fields[i] != key.Field {
+			return nil, &Error{Message: "cursor does not match sort"}
+		}
+	}
+
+	return data.Values, nil
+}
+
+func readableField(p *policy.Policy, admin bool, name string) (policy.Field, error) {
+	field, ok := p.Lookup(name)
+	if !ok || !field.CanRead(admin) {
+		return policy.Field{}, &Error{Message: fmt.Sprintf("cannot filter or sort by %q", name)}
+	}
+
+	return field, nil
+}
+
+// parseValue converts a query-string value into the field's type, accepting
+// either a JSON literal (`42`, `true`) or a bare string.
+func parseValue(field policy.Field, raw string) (interface{}, error) {
+	// Array fields are matched on their elements.
+	if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() != reflect.Uint8 {
+		field.Type = field.Type.Elem()
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(raw), &decoded); err == nil {
+		if value, err := field.Decode(decoded); err == nil {
+			return value, nil
+		}
+	}
+
+	value, err := field.Decode(raw)
+	if err != nil {
+		return nil, &Error{Message: err.Error()}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,263 @@
+package listing
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+	"white-label-crm/app/policy"
+)
+
+type testRecord struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Name      string             `json:"name" bson:"name"`
+	Age       int                `json:"age" bson:"age"`
+	Tags      []string           `json:"tags" bson:"tags"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	Secret    string             `json:"-" bson:"secret"`
+	Notes     string             `json:"notes" bson:"notes" access:"admin"`
+}
+
+// parse runs Parse against a request with the given query string.
+func parse(t *testing.T, query string, admin bool) (*Params, error) {
+	t.Helper()
+
+	var params *Params
+	var err error
+
+	app := fiber.New()
+	app.Get("/", func(ctx *fiber.Ctx) error {
+		params, err = Parse(ctx, policy.For(&testRecord{}), admin)
+		return nil
+	})
+
+	if _, testErr := app.Test(httptest.NewRequest("GET", "/?"+query, nil)); testErr != nil {
+		t.Fatalf("app.Test: %v", testErr)
+	}
+
+	return params, err
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		admin   bool
+		want    bson.M
+		wantErr bool
+	}{
+		{
+			name:  "none",
+			query: "",
+			want:  bson.M{},
+		},
+		{
+			name:  "implicit eq",
+			query: "filter[name]=John",
+			want:  bson.M{"name": bson.M{"$eq": "John"}},
+		},
+		{
+			name:  "typed comparison",
+			query: "filter[age][gte]=18&filter[age][lt]=65",
+			want:  bson.M{"age": bson.M{"$gte": 18, "$lt": 65}},
+		},
+		{
+			name:  "json literal for a string field",
+			query: "filter[name]=42",
+			want:  bson.M{"name": bson.M{"$eq": "42"}},
+		},
+		{
+			name:  "in",
+			query: "filter[age][in]=1,2,3",
+			want:  bson.M{"age": bson.M{"$in": bson.A{1, 2, 3}}},
+		},
+		{
+			name:  "array element",
+			query: "filter[tags]=vip",
+			want:  bson.M{"tags": bson.M{"$eq": "vip"}},
+		},
+		{
+			name:  "contains is escaped",
+			query: "filter[name][contains]=a.b",
+			want:  bson.M{"name": bson.M{"$regex": `a\.b`, "$options": "i"}},
+		},
+		{
+			name:  "startsWith",
+			query: "filter[name][startsWith]=Jo",
+			want:  bson.M{"name": bson.M{"$regex": "^Jo"}},
+		},
+		{
+			name:  "exists",
+			query: "filter[notes][exists]=false",
+			admin: true,
+			want:  bson.M{"notes": bson.M{"$exists": false}},
+		},
+		{
+			name:  "bson name",
+			query: "filter[_id][exists]=true",
+			want:  bson.M{"_id": bson.M{"$exists": true}},
+		},
+		{name: "unknown operator", query: "filter[name][regex]=.*", wantErr: true},
+		{name: "unknown field", query: "filter[missing]=1", wantErr: true},
+		{name: "hidden field", query: "filter[secret]=x", wantErr: true},
+		{name: "admin field", query: "filter[notes]=x", wantErr: true},
+		{name: "invalid value", query: "filter[age]=old", wantErr: true},
+		{name: "invalid exists", query: "filter[name][exists]=maybe", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parse(t, tt.query, tt.admin)
+			if tt.wantErr {
+				var listErr *Error
+				if !errors.As(err, &listErr) {
+					t.Fatalf("Parse(%q) error = %v, want *Error", tt.query, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.query, err)
+			}
+
+			if !reflect.DeepEqual(params.Filter, tt.want) {
+				t.Errorf("Parse(%q) filter = %v, want %v", tt.query, params.Filter, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSortAndLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    []SortKey
+		limit   int64
+		wantErr bool
+	}{
+		{
+			name:  "default",
+			query: "",
+			want:  []SortKey{{Field: "_id"}},
+			limit: DefaultLimit,
+		},
+		{
+			name:  "tie breaker follows the last key",
+			query: "sort=name,-createdAt&limit=10",
+			want:  []SortKey{{Field: "name"}, {Field: "createdAt", Descending: true}, {Field: "_id", Descending: true}},
+			limit: 10,
+		},
+		{
+			name:  "explicit id is not repeated",
+			query: "sort=-id",
+			want:  []SortKey{{Field: "_id"}},
+			limit: DefaultLimit,
+		},
+		{name: "hidden field", query: "sort=secret", wantErr: true},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "limit above max", query: "limit=101", wantErr: true},
+		{name: "both cursors", query: "after=x&before=y", wantErr: true},
+		{name: "garbage cursor", query: "after=!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parse(t, tt.query, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) succeeded, want an error", tt.query)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.query, err)
+			}
+
+			if !reflect.DeepEqual(params.Sort, tt.want) {
+				t.Errorf("Parse(%q) sort = %v, want %v", tt.query, params.Sort, tt.want)
+			}
+
+			if params.Limit != tt.limit {
+				t.Errorf("Parse(%q) limit = %d, want %d", tt.query, params.Limit, tt.limit)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	record := &testRecord{
+		ID:        primitive.NewObjectID(),
+		Name:      "Jane",
+		Age:       30,
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	sort := []SortKey{{Field: "name"}, {Field: "createdAt", Descending: true}, {Field: "_id", Descending: true}}
+	cursor, err := encodeCursor(record, sort)
+	if err != nil {
+		t.Fatalf("encodeCursor: %v", err)
+	}
+
+	values, err := decodeCursor(cursor, sort)
+	if err != nil {
+		t.Fatalf("decodeCursor: %v", err)
+	}
+
+	want := []interface{}{"Jane", primitive.NewDateTimeFromTime(record.CreatedAt), record.ID}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("decodeCursor = %#v, want %#v", values, want)
+	}
+
+	mismatched := [][]SortKey{
+		{{Field: "_id"}},
+		{{Field: "age"}, {Field: "createdAt", Descending: true}, {Field: "_id", Descending: true}},
+	}
+	for _, other := range mismatched {
+		if _, err := decodeCursor(cursor, other); err == nil {
+			t.Errorf("decodeCursor with sort %v succeeded, want an error", other)
+		}
+	}
+}
+
+func TestKeysetFilter(t *testing.T) {
+	sort := []SortKey{{Field: "name"}, {Field: "_id"}}
+	values := []interface{}{"Jane", 7}
+
+	tests := []struct {
+		name      string
+		backwards bool
+		want      bson.A
+	}{
+		{
+			name: "forwards",
+			want: bson.A{
+				bson.M{"name": bson.M{"$gt": "Jane"}},
+				bson.M{"name": "Jane", "_id": bson.M{"$gt": 7}},
+			},
+		},
+		{
+			name:      "backwards",
+			backwards: true,
+			want: bson.A{
+				bson.M{"name": bson.M{"$lt": "Jane"}},
+				bson.M{"name": "Jane", "_id": bson.M{"$lt": 7}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keysetFilter(sort, values, tt.backwards)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keysetFilter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
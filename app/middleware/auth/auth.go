@@ -1,9 +1,18 @@
 package auth
 
 import (
+	"errors"
 	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
 	"slices"
+	"strings"
+	"white-label-crm/app/models"
+	"white-label-crm/app/session"
 	"white-label-crm/database"
+	"white-label-crm/jwt"
 )
 
 type Config struct {
@@ -14,25 +23,99 @@ func New(config Config) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		path := ctx.Path()
 		if slices.Contains(config.ExcludePaths, path) {
-			ctx.Locals(
-				"user",
-				database.UserRelation{
-					ID:   0,
-					Name: "System",
-				},
-			)
+			ctx.Locals("user", database.SystemUser)
 
 			return ctx.Next()
 		}
 
-		ctx.Locals(
-			"user",
-			database.UserRelation{
-				ID:   1,
-				Name: "Admin",
-			},
+		token := bearerToken(ctx)
+		if len(token) == 0 {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		userID, err := resolveUserID(ctx, token)
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		// Load the user
+		user, err := database.FindOne[models.User](
+			database.GetBrandDb(ctx),
+			ctx.UserContext(),
+			bson.M{"_id": userID},
 		)
+		if err != nil {
+			if !errors.Is(err, mongo.ErrNoDocuments) {
+				log.Printf("[auth middleware] %v\n", err)
+			}
+
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		ctx.Locals("user", user.Relation())
+		ctx.Locals("currentUser", user)
 
 		return ctx.Next()
 	}
 }
+
+// CurrentUser returns the authenticated user, or nil for excluded paths.
+func CurrentUser(ctx *fiber.Ctx) *models.User {
+	user, _ := ctx.Locals("currentUser").(*models.User)
+	return user
+}
+
+// resolveUserID accepts either a signed JWT access token or an opaque
+// session token.
+func resolveUserID(ctx *fiber.Ctx, token string) (primitive.ObjectID, error) {
+	if jwt.IsJWT(token) {
+		brand, ok := ctx.Locals("brand").(models.Brand)
+		if !ok {
+			return primitive.NilObjectID, jwt.ErrInvalidAudience
+		}
+
+		userID, err := session.VerifyAccessToken(ctx.UserContext(), brand, token)
+		if err != nil && !isTokenError(err) {
+			log.Printf("[auth middleware] %v\n", err)
+		}
+
+		return userID, err
+	}
+
+	dbName, ok := ctx.Locals("dbName").(string)
+	if !ok {
+		return primitive.NilObjectID, session.ErrNotFound
+	}
+
+	sess, err := session.Get(ctx.UserContext(), dbName, token)
+	if err != nil {
+		if !errors.Is(err, session.ErrNotFound) {
+			log.Printf("[auth middleware] %v\n", err)
+		}
+
+		return primitive.NilObjectID, err
+	}
+
+	ctx.Locals("sessionToken", token)
+	return sess.UserID, nil
+}
+
+func isTokenError(err error) bool {
+	return errors.Is(err, jwt.ErrMalformed) ||
+		errors.Is(err, jwt.ErrInvalidSignature) ||
+		errors.Is(err, jwt.ErrInvalidAlgorithm) ||
+		errors.Is(err, jwt.ErrInvalidAudience) ||
+		errors.Is(err, jwt.ErrExpired) ||
+		errors.Is(err, jwt.ErrNotYetValid) ||
+		errors.Is(err, session.ErrUnknownKey) ||
+		errors.Is(err, session.ErrNoSigningKey)
+}
+
+func bearerToken(ctx *fiber.Ctx) string {
+	header := ctx.Get(fiber.HeaderAuthorization)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(header[7:])
+}
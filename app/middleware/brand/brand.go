@@ -1,41 +1,149 @@
 package brand
 
 import (
-	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
-	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
+	"net/netip"
+	"slices"
 	"strings"
 	"white-label-crm/app/models"
+	"white-label-crm/app/quota"
 	"white-label-crm/database"
-	"white-label-crm/redis"
 )
 
-func New() fiber.Handler {
+// Strategy is a way for a request to select its brand.
+type Strategy string
+
+const (
+	// StrategyHost matches the Host header against the brand domains.
+	StrategyHost Strategy = "host"
+	// StrategyHeader takes the brand slug from the X-Brand header.
+	StrategyHeader Strategy = "header"
+	// StrategyQuery takes the brand slug from the ?brand= parameter.
+	StrategyQuery Strategy = "query"
+	// StrategyPath takes the brand slug from a /b/<slug> path prefix, which
+	// is stripped before routing.
+	StrategyPath Strategy = "path"
+)
+
+const (
+	brandHeader = "X-Brand"
+	brandQuery  = "brand"
+	pathPrefix  = "/b/"
+)
+
+type Config struct {
+	// Strategies are tried in order and the first one the request uses
+	// selects the brand. As every request has a host, StrategyHost only
+	// makes sense last. Defaults to StrategyHost alone.
+	Strategies []Strategy
+	// TrustedNetworks, in CIDR notation, limits the header and query
+	// strategies to requests coming from them. Requests from elsewhere
+	// using either are refused. Empty trusts every network. Matching is on
+	// the peer address, which is the proxy for proxied requests.
+	TrustedNetworks []string
+	// RedirectToCanonical redirects requests made on another of the brand's
+	// domains to its canonical domain. Hosts matched through a wildcard are
+	// served as they are.
+	RedirectToCanonical bool
+}
+
+func New(config Config) fiber.Handler {
+	if len(config.Strategies) == 0 {
+		config.Strategies = []Strategy{StrategyHost}
+	}
+
+	var trusted []netip.Prefix
+	for _, network := range config.TrustedNetworks {
+		trusted = append(trusted, netip.MustParsePrefix(network))
+	}
+
 	return func(ctx *fiber.Ctx) error {
-		hostname := ctx.Hostname()
-		// Remove port from hostname (dev environment)
-		if idx := strings.Index(hostname, ":"); idx > -1 {
-			hostname = hostname[:idx]
-			if len(strings.TrimSpace(hostname)) == 0 {
-				log.Printf("[brand middleware] Invalid hostname | Raw(%v) | Parsed(%v)\n", ctx.Hostname(), hostname)
-				return ctx.SendStatus(fiber.StatusNotFound)
+		var (
+			data     map[string]string
+			err      error
+			strategy Strategy
+			hostname string
+			port     string
+		)
+
+	strategies:
+		for _, strategy = range config.Strategies {
+			switch strategy {
+			case StrategyHost:
+				hostname = ctx.Hostname()
+				// Remove port from hostname (dev environment)
+				if idx := strings.Index(hostname, ":"); idx > -1 {
+					hostname, port = hostname[:idx], hostname[idx:]
+					if len(strings.TrimSpace(hostname)) == 0 {
+						log.Printf("[brand middleware] Invalid hostname | Raw(%v) | Parsed(%v)\n", ctx.Hostname(), hostname)
+						return ctx.SendStatus(fiber.StatusNotFound)
+					}
+				}
+
+				data, err = resolveHost(ctx.UserContext(), hostname)
+				break strategies
+			case StrategyHeader, StrategyQuery:
+				slug := ctx.Get(brandHeader)
+				if strategy == StrategyQuery {
+					slug = ctx.Query(brandQuery)
+				}
+
+				if len(slug) == 0 {
+					continue
+				}
+
+				if !isTrusted(trusted, ctx.IP()) {
+					return ctx.Status(fiber.StatusForbidden).JSON(
+						fiber.Map{"error": fmt.Sprintf("selecting the brand by %s is not allowed from this network", strategy)},
+					)
+				}
+
+				data, err = resolveSlug(ctx.UserContext(), slug)
+				break strategies
+			case StrategyPath:
+				rest, ok := strings.CutPrefix(ctx.Path(), pathPrefix)
+				if !ok {
+					continue
+				}
+
+				slug, rest, _ := strings.Cut(rest, "/")
+				if len(slug) == 0 {
+					continue
+				}
+
+				// Route the rest of the path as if there was no prefix.
+				ctx.Path("/" + rest)
+
+				data, err = resolveSlug(ctx.UserContext(), slug)
+				break strategies
 			}
 		}
 
-		// Lookup brand
-		data, err := redis.Client.HGetAll(context.Background(), fmt.Sprintf("brands:%s", hostname)).Result()
 		if err != nil {
-			if !errors.Is(err, redis2.Nil) {
-				log.Printf("[brand middleware] %v\n", err)
-			}
+			log.Printf("[brand middleware] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
 
+		if data == nil {
 			return ctx.SendStatus(fiber.StatusNotFound)
 		}
 
+		// The data of a suspended brand is kept, it's only not served.
+		if data["suspended"] == "1" {
+			return ctx.Status(fiber.StatusServiceUnavailable).JSON(
+				fiber.Map{
+					"error":   "maintenance",
+					"message": fmt.Sprintf("%s is unavailable for maintenance", data["name"]),
+				},
+			)
+		}
+
 		id, err := primitive.ObjectIDFromHex(data["_id"])
 		if err != nil {
 			log.Printf("[brand middleware] %v\n", err)
@@ -44,14 +152,100 @@ func New() fiber.Handler {
 
 		// Store the brand on the context
 		brand := models.Brand{
-			Model:  database.Model{ID: id},
-			Name:   data["name"],
-			Slug:   data["slug"],
-			Domain: data["domain"],
+			Model:           database.Model{ID: id},
+			Name:            data["name"],
+			Slug:            data["slug"],
+			Domains:         strings.Split(data["domains"], ","),
+			CanonicalDomain: data["canonicalDomain"],
+			Plan:            data["plan"],
+		}
+
+		if len(data["settings"]) > 0 {
+			var settings models.BrandSettings
+			if err := bson.UnmarshalExtJSON([]byte(data["settings"]), false, &settings); err != nil {
+				// Serve the brand with the default settings rather than not at all.
+				log.Printf("[brand middleware] Settings of %s | %v\n", brand.Slug, err)
+			} else {
+				brand.Settings = &settings
+			}
 		}
 
-		ctx.Locals("dbName", fmt.Sprintf("brand_%s", brand.Slug))
+		if len(data["limits"]) > 0 {
+			var limits models.PlanLimits
+			if err := bson.UnmarshalExtJSON([]byte(data["limits"]), false, &limits); err != nil {
+				log.Printf("[brand middleware] Limits of %s | %v\n", brand.Slug, err)
+			} else {
+				brand.Limits = &limits
+			}
+		}
+
+		if len(data["databaseUri"]) > 0 {
+			brand.Cluster = data["cluster"]
+			brand.DatabaseURI, err = base64.StdEncoding.DecodeString(data["databaseUri"])
+			if err != nil {
+				log.Printf("[brand middleware] Database URI of %s | %v\n", brand.Slug, err)
+				return ctx.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		// Connect to a dedicated cluster now, rather than fail deep in a
+		// handler.
+		if _, err := brand.Db(); err != nil {
+			log.Printf("[brand middleware] Database of %s | %v\n", brand.Slug, err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if config.RedirectToCanonical &&
+			strategy == StrategyHost &&
+			hostname != brand.CanonicalDomain &&
+			len(brand.CanonicalDomain) > 0 &&
+			slices.Contains(brand.Domains, hostname) {
+			// 308 keeps the method and body of API calls.
+			return ctx.Redirect(
+				ctx.Protocol()+"://"+brand.CanonicalDomain+port+ctx.OriginalURL(),
+				fiber.StatusPermanentRedirect,
+			)
+		}
+
+		if err := quota.CountAPICall(ctx.UserContext(), brand); err != nil {
+			var exceeded *quota.ExceededError
+			if errors.As(err, &exceeded) {
+				return quota.SendExceeded(ctx, err)
+			}
+
+			// Not being able to count doesn't stop the brand from working.
+			log.Printf("[brand middleware] %v\n", err)
+		}
+
+		ctx.Locals("dbName", brand.DbName())
+		ctx.Locals("cluster", brand.DatabaseCluster())
 		ctx.Locals("brand", brand)
 		return ctx.Next()
 	}
 }
+
+// Current returns the brand of the request, set by the middleware.
+func Current(ctx *fiber.Ctx) (models.Brand, bool) {
+	brand, ok := ctx.Locals("brand").(models.Brand)
+	return brand, ok
+}
+
+func isTrusted(trusted []netip.Prefix, ip string) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
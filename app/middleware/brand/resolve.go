@@ -0,0 +1,175 @@
+package brand
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"slices"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/redis"
+	"white-label-crm/utils"
+)
+
+const (
+	localCacheSize = 10_000
+	// Instances aren't told about brand changes, so keep this short.
+	localCacheTTL = 5 * time.Second
+	// How long an unknown host or slug is remembered as such in Redis.
+	missingTTL = 30 * time.Second
+)
+
+var (
+	// Keyed by "host:<host>" or "slug:<slug>". Unknown ones are cached as
+	// nil.
+	local   = utils.NewLRU[string, map[string]string](localCacheSize, localCacheTTL)
+	lookups singleflight.Group
+)
+
+// resolveHost returns the cached fields of the brand served on the host,
+// or nil when there's none.
+func resolveHost(ctx context.Context, host string) (map[string]string, error) {
+	return resolve(ctx, "host:"+host, func() (map[string]string, error) {
+		return lookupHost(ctx, host)
+	})
+}
+
+// resolveSlug returns the cached fields of the brand with the slug, or nil
+// when there's none.
+func resolveSlug(ctx context.Context, slug string) (map[string]string, error) {
+	return resolve(ctx, "slug:"+slug, func() (map[string]string, error) {
+		return lookupSlug(ctx, slug)
+	})
+}
+
+// resolve reads through the in-process cache, then Redis and finally the
+// system database, filling the caches on the way back.
+func resolve(ctx context.Context, key string, lookup func() (map[string]string, error)) (map[string]string, error) {
+	if data, ok := local.Get(key); ok {
+		return data, nil
+	}
+
+	// Concurrent requests for the same brand share one lookup.
+	result, err, _ := lookups.Do(
+		key,
+		func() (interface{}, error) {
+			data, err := lookup()
+			if err != nil {
+				return nil, err
+			}
+
+			local.Set(key, data)
+			return data, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(map[string]string), nil
+}
+
+func lookupHost(ctx context.Context, host string) (map[string]string, error) {
+	cached, missing, err := database.FindCachedBrand(ctx, host)
+	if err == nil {
+		if cached != nil {
+			return cached, nil
+		}
+
+		if missing {
+			return nil, nil
+		}
+	} else {
+		// Keep serving from Mongo while Redis is unavailable.
+		log.Printf("[brand.lookupHost] %v\n", err)
+	}
+
+	domains := bson.A{host}
+	if wildcard := database.WildcardFor(host); len(wildcard) > 0 {
+		domains = append(domains, wildcard)
+	}
+
+	brands, err := database.GetSystemDb().Collection((&models.Brand{}).GetCollectionName()).Find(
+		ctx,
+		bson.M{
+			"domains":   bson.M{"$in": domains},
+			"deletedAt": bson.M{"$exists": false},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.M
+	if err := brands.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	if len(docs) == 0 {
+		if err := redis.Client.Set(ctx, database.MissingBrandKey(host), "1", missingTTL).Err(); err != nil {
+			log.Printf("[brand.lookupHost] %v\n", err)
+		}
+
+		return nil, nil
+	}
+
+	// An exact domain wins over a wildcard.
+	doc := docs[0]
+	for _, candidate := range docs {
+		exact, _ := candidate["domains"].(bson.A)
+		if slices.Contains(exact, interface{}(host)) {
+			doc = candidate
+		}
+	}
+
+	if err := database.CacheBrand(ctx, doc); err != nil {
+		log.Printf("[brand.lookupHost] %v\n", err)
+	}
+
+	return database.CachedBrandFields(doc), nil
+}
+
+func lookupSlug(ctx context.Context, slug string) (map[string]string, error) {
+	cached, missing, err := database.FindCachedBrandBySlug(ctx, slug)
+	if err == nil {
+		if cached != nil {
+			return cached, nil
+		}
+
+		if missing {
+			return nil, nil
+		}
+	} else {
+		log.Printf("[brand.lookupSlug] %v\n", err)
+	}
+
+	var doc bson.M
+	err = database.GetSystemDb().Collection((&models.Brand{}).GetCollectionName()).FindOne(
+		ctx,
+		bson.M{
+			"slug":      slug,
+			"deletedAt": bson.M{"$exists": false},
+		},
+	).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if err := redis.Client.Set(ctx, database.MissingBrandSlugKey(slug), "1", missingTTL).Err(); err != nil {
+			log.Printf("[brand.lookupSlug] %v\n", err)
+		}
+
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.CacheBrand(ctx, doc); err != nil {
+		log.Printf("[brand.lookupSlug] %v\n", err)
+	}
+
+	return database.CachedBrandFields(doc), nil
+}
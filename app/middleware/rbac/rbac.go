@@ -0,0 +1,96 @@
+package rbac
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"log"
+	"slices"
+	"strings"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+)
+
+// Require only lets the request through when the current user has every
+// one of the given permissions.
+func Require(permissions ...string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if _, ok := ctx.Locals("currentUser").(*models.User); !ok {
+			return ctx.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		granted, err := Permissions(ctx)
+		if err != nil {
+			log.Printf("[rbac middleware] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		for _, permission := range permissions {
+			if !Matches(granted, permission) {
+				return ctx.SendStatus(fiber.StatusForbidden)
+			}
+		}
+
+		return ctx.Next()
+	}
+}
+
+// Can reports whether the current user has the permission.
+func Can(ctx *fiber.Ctx, permission string) bool {
+	granted, err := Permissions(ctx)
+	if err != nil {
+		log.Printf("[rbac.Can] %v\n", err)
+		return false
+	}
+
+	return Matches(granted, permission)
+}
+
+// Permissions returns the union of the permissions from all the current
+// user's roles. The result is cached for the rest of the request.
+func Permissions(ctx *fiber.Ctx) ([]string, error) {
+	if permissions, ok := ctx.Locals("permissions").([]string); ok {
+		return permissions, nil
+	}
+
+	user, ok := ctx.Locals("currentUser").(*models.User)
+	if !ok || len(user.Roles) == 0 {
+		return []string{}, nil
+	}
+
+	roles, err := database.Find[models.Role](
+		database.GetBrandDb(ctx),
+		ctx.UserContext(),
+		bson.M{"slug": bson.M{"$in": user.Roles}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+
+	ctx.Locals("permissions", permissions)
+	return permissions, nil
+}
+
+// Matches checks a permission against a granted set. A granted permission
+// of "*" matches everything and "users.*" matches anything under "users.".
+func Matches(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == "*" || g == permission {
+			return true
+		}
+
+		if prefix, ok := strings.CutSuffix(g, "*"); ok && strings.HasPrefix(permission, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
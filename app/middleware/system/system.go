@@ -0,0 +1,15 @@
+package system
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// New points every request at the system database instead of resolving a
+// brand, for the admin API. database.GetBrandDb then returns the system
+// database, so the brand-agnostic services and middlewares work unchanged.
+func New() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		ctx.Locals("dbName", "system")
+		return ctx.Next()
+	}
+}
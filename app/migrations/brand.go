@@ -0,0 +1,152 @@
+package migrations
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/migrations"
+)
+
+// backfilledRolesField marks the users given a role by the backfill.
+const backfilledRolesField = "rolesBackfilled"
+
+func init() {
+	migrations.Register(
+		migrations.Migration{
+			ID:          "20240901000000_seed_default_roles",
+			Scope:       migrations.ScopeBrand,
+			Description: "Create the built-in roles.",
+			Up:          seedDefaultRoles,
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection((&models.Role{}).GetCollectionName()).
+					DeleteMany(ctx, bson.M{"system": true})
+				return err
+			},
+		},
+		migrations.Migration{
+			ID:          "20240901000100_backfill_user_roles",
+			Scope:       migrations.ScopeBrand,
+			Description: "Give users without any role the registered role.",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				// Backfilled users are marked so Down only reverts them.
+				_, err := db.Collection((&models.User{}).GetCollectionName()).UpdateMany(
+					ctx,
+					bson.M{"$or": bson.A{bson.M{"roles": nil}, bson.M{"roles": bson.A{}}}},
+					bson.M{"$set": bson.M{"roles": bson.A{models.RegisteredRole}, backfilledRolesField: true}},
+				)
+				return err
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection((&models.User{}).GetCollectionName()).UpdateMany(
+					ctx,
+					bson.M{backfilledRolesField: true},
+					bson.M{"$set": bson.M{"roles": bson.A{}}, "$unset": bson.M{backfilledRolesField: true}},
+				)
+				return err
+			},
+		},
+		migrations.Migration{
+			ID:          "20241001000000_seed_default_pipelines",
+			Scope:       migrations.ScopeBrand,
+			Description: "Create the default sales pipeline.",
+			Up:          seedDefaultPipelines,
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				var slugs bson.A
+				for _, pipeline := range models.DefaultPipelines() {
+					slugs = append(slugs, pipeline.Slug)
+				}
+
+				_, err := db.Collection((&models.Pipeline{}).GetCollectionName()).
+					DeleteMany(ctx, bson.M{"slug": bson.M{"$in": slugs}})
+				return err
+			},
+		},
+		migrations.Migration{
+			ID:          "20241001000100_grant_pipeline_permissions",
+			Scope:       migrations.ScopeBrand,
+			Description: "Give the built-in roles access to pipelines.",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return updateSystemRoles(ctx, db, "$addToSet")
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				return updateSystemRoles(ctx, db, "$pull")
+			},
+		},
+	)
+}
+
+func updateSystemRoles(ctx context.Context, db *mongo.Database, operator string) error {
+	grants := map[string]string{
+		"admin":  "pipelines.*",
+		"member": "pipelines.read",
+	}
+
+	for slug, permission := range grants {
+		_, err := db.Collection((&models.Role{}).GetCollectionName()).UpdateOne(
+			ctx,
+			bson.M{"slug": slug, "system": true},
+			bson.M{operator: bson.M{"permissions": permission}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func seedDefaultRoles(ctx context.Context, db *mongo.Database) error {
+	now := time.Now()
+	for _, role := range models.DefaultRoles() {
+		role.Model = database.Model{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: now,
+			UpdatedAt: now,
+			UpdatedBy: database.SystemUser,
+			Version:   1,
+		}
+
+		// Leave roles that already exist alone.
+		_, err := db.Collection(role.GetCollectionName()).UpdateOne(
+			ctx,
+			bson.M{"slug": role.Slug},
+			bson.M{"$setOnInsert": role},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func seedDefaultPipelines(ctx context.Context, db *mongo.Database) error {
+	now := time.Now()
+	for _, pipeline := range models.DefaultPipelines() {
+		pipeline.Model = database.Model{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: now,
+			UpdatedAt: now,
+			UpdatedBy: database.SystemUser,
+			Version:   1,
+		}
+
+		_, err := db.Collection(pipeline.GetCollectionName()).UpdateOne(
+			ctx,
+			bson.M{"slug": pipeline.Slug},
+			bson.M{"$setOnInsert": pipeline},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/migrations"
+)
+
+func init() {
+	migrations.Register(
+		migrations.Migration{
+			ID:          "20241015000000_seed_superadmin_role",
+			Scope:       migrations.ScopeSystem,
+			Description: "Create the role of the admin API administrators.",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				now := time.Now()
+				role := models.SuperAdminRole()
+				role.Model = database.Model{
+					ID:        primitive.NewObjectID(),
+					CreatedAt: now,
+					UpdatedAt: now,
+					UpdatedBy: database.SystemUser,
+					Version:   1,
+				}
+
+				_, err := db.Collection(role.GetCollectionName()).UpdateOne(
+					ctx,
+					bson.M{"slug": role.Slug},
+					bson.M{"$setOnInsert": role},
+					options.Update().SetUpsert(true),
+				)
+				return err
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection((&models.Role{}).GetCollectionName()).
+					DeleteOne(ctx, bson.M{"slug": models.SuperAdminRole().Slug})
+				return err
+			},
+		},
+		migrations.Migration{
+			ID:          "20241101000000_brand_domains",
+			Scope:       migrations.ScopeSystem,
+			Description: "Move the domain of brands into their list of domains.",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				brands := db.Collection((&models.Brand{}).GetCollectionName())
+
+				// The unique index on the old field would see every brand
+				// as having the same, missing, domain.
+				if err := dropIndex(ctx, brands, "domain_1_deletedAt_1"); err != nil {
+					return err
+				}
+
+				_, err := brands.UpdateMany(
+					ctx,
+					bson.M{"domain": bson.M{"$exists": true}},
+					mongo.Pipeline{
+						{{Key: "$set", Value: bson.M{"domains": bson.A{"$domain"}, "canonicalDomain": "$domain"}}},
+						{{Key: "$unset", Value: "domain"}},
+					},
+				)
+				return err
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection((&models.Brand{}).GetCollectionName()).UpdateMany(
+					ctx,
+					bson.M{"canonicalDomain": bson.M{"$exists": true}},
+					mongo.Pipeline{
+						{{Key: "$set", Value: bson.M{"domain": "$canonicalDomain"}}},
+						{{Key: "$unset", Value: bson.A{"domains", "canonicalDomain"}}},
+					},
+				)
+				return err
+			},
+		},
+		migrations.Migration{
+			ID:          "20241115000000_grandfather_brand_plans",
+			Scope:       migrations.ScopeSystem,
+			Description: "Put the brands that predate plans on the unlimited plan.",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection((&models.Brand{}).GetCollectionName()).UpdateMany(
+					ctx,
+					bson.M{"plan": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"plan": "enterprise"}},
+				)
+				return err
+			},
+		},
+	)
+}
+
+// dropIndex drops the index unless it, or its collection, doesn't exist.
+func dropIndex(ctx context.Context, collection *mongo.Collection, name string) error {
+	_, err := collection.Indexes().DropOne(ctx, name)
+
+	var serverErr mongo.ServerError
+	// NamespaceNotFound, IndexNotFound
+	if errors.As(err, &serverErr) && (serverErr.HasErrorCode(26) || serverErr.HasErrorCode(27)) {
+		return nil
+	}
+
+	return err
+}
@@ -1,15 +1,177 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 	"white-label-crm/database"
 )
 
+var (
+	brandSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+	domainPattern    = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+)
+
 type Brand struct {
 	database.Model `bson:",inline"`
 
-	Name   string `json:"name" bson:"name"`
-	Slug   string `json:"slug" bson:"slug"`
-	Domain string `json:"domain" bson:"domain"`
+	Name string `json:"name" bson:"name" access:"writable"`
+	// Slug names the brand database, so it can't change.
+	Slug string `json:"slug" bson:"slug" access:"immutable"`
+	// Domains the brand is served on. "*.customer.example.com" covers every
+	// direct subdomain of customer.example.com.
+	Domains []string `json:"domains" bson:"domains" access:"writable"`
+	// CanonicalDomain is one of Domains, used in links and that the other
+	// domains redirect to.
+	CanonicalDomain string `json:"canonicalDomain" bson:"canonicalDomain" access:"writable"`
+	// Owner is invited as the first user of the brand once provisioned.
+	Owner        *BrandOwner        `json:"owner,omitempty" bson:"owner,omitempty" access:"immutable"`
+	Settings     *BrandSettings     `json:"settings,omitempty" bson:"settings,omitempty" access:"writable"`
+	Provisioning *BrandProvisioning `json:"provisioning,omitempty" bson:"provisioning,omitempty"`
+	// Plan is one of Plans, DefaultPlan when empty.
+	Plan string `json:"plan,omitempty" bson:"plan,omitempty" access:"writable"`
+	// Limits replace those of the plan, for brands with a custom deal.
+	Limits *PlanLimits `json:"limits,omitempty" bson:"limits,omitempty" access:"writable"`
+	// DatabaseURI, encrypted with database.EncryptURI, is the dedicated
+	// cluster holding the brand database. Without it the brand is on the
+	// shared cluster. Only moving the brand changes it, as the data has to
+	// follow.
+	DatabaseURI []byte `json:"-" bson:"databaseUri,omitempty"`
+	// Cluster is the database.ClusterID of DatabaseURI.
+	Cluster string `json:"cluster,omitempty" bson:"cluster,omitempty"`
+	// MovingAt is set while the brand moves to another cluster, during
+	// which it can't be used.
+	MovingAt *time.Time `json:"movingAt,omitempty" bson:"movingAt,omitempty"`
+	// Suspended brands can't be used until they're unsuspended.
+	SuspendedAt     *time.Time `json:"suspendedAt,omitempty" bson:"suspendedAt,omitempty"`
+	SuspendedReason string     `json:"suspendedReason,omitempty" bson:"suspendedReason,omitempty"`
 }
 
 func (b *Brand) GetCollectionName() string { return "brands" }
+
+func (b *Brand) Indexes() []database.Index {
+	return []database.Index{
+		// The slug names the brand database.
+		database.LiveUnique("slug"),
+		// Unique per domain, not per list of domains
+		database.LiveUnique("domains"),
+		database.TrashIndex(),
+	}
+}
+
+func (b *Brand) Validate() error {
+	if !brandSlugPattern.MatchString(b.Slug) {
+		return errors.New("slug must be lowercase letters, digits and dashes, up to 40 characters")
+	}
+
+	if len(b.Name) == 0 {
+		return errors.New("name is required")
+	}
+
+	if len(b.Domains) == 0 {
+		return errors.New("at least one domain is required")
+	}
+
+	for _, domain := range b.Domains {
+		if !domainPattern.MatchString(strings.TrimPrefix(domain, "*.")) {
+			return fmt.Errorf("domain %q must be a lowercase host name, without scheme or port", domain)
+		}
+	}
+
+	if !slices.Contains(b.Domains, b.CanonicalDomain) || strings.HasPrefix(b.CanonicalDomain, "*.") {
+		return errors.New("canonical domain must be one of the domains, and not a wildcard")
+	}
+
+	if b.Owner != nil && !strings.Contains(b.Owner.Email, "@") {
+		return errors.New("owner email must be a valid email address")
+	}
+
+	if err := validatePlan(b.Plan); err != nil {
+		return err
+	}
+
+	if b.Settings != nil {
+		return b.Settings.Validate()
+	}
+
+	return nil
+}
+
+// EffectiveLimits are the limits the brand is held to.
+func (b *Brand) EffectiveLimits() PlanLimits {
+	if b.Limits != nil {
+		return *b.Limits
+	}
+
+	plan, ok := Plans()[b.Plan]
+	if !ok {
+		plan = Plans()[DefaultPlan]
+	}
+
+	return plan.Limits
+}
+
+// EffectiveSettings are the brand settings with defaults for whatever
+// wasn't set.
+func (b *Brand) EffectiveSettings() BrandSettings {
+	settings := BrandSettings{}
+	if b.Settings != nil {
+		settings = *b.Settings
+	}
+
+	return settings.WithDefaults()
+}
+
+// DbName is the name of the brand's own database.
+func (b *Brand) DbName() string {
+	return "brand_" + b.Slug
+}
+
+// DatabaseCluster is the dedicated cluster of the brand, or nil for the
+// shared one.
+func (b *Brand) DatabaseCluster() *database.Cluster {
+	if len(b.DatabaseURI) == 0 {
+		return nil
+	}
+
+	return &database.Cluster{ID: b.Cluster, URI: b.DatabaseURI}
+}
+
+// Db returns the brand's own database, on whichever cluster it is.
+func (b *Brand) Db() (*mongo.Database, error) {
+	return database.GetClusterDb(b.DatabaseCluster(), b.DbName())
+}
+
+type BrandOwner struct {
+	Name  string `json:"name" bson:"name"`
+	Email string `json:"email" bson:"email"`
+}
+
+type ProvisioningStatus string
+
+const (
+	ProvisioningPending ProvisioningStatus = "pending"
+	ProvisioningRunning ProvisioningStatus = "running"
+	ProvisioningReady   ProvisioningStatus = "ready"
+	ProvisioningFailed  ProvisioningStatus = "failed"
+)
+
+// BrandProvisioning tracks the setup of the brand database. Brands without
+// it predate provisioning.
+type BrandProvisioning struct {
+	Status   ProvisioningStatus `json:"status" bson:"status"`
+	Attempts int                `json:"attempts" bson:"attempts"`
+	// Step is the step that is running, or that failed.
+	Step          string     `json:"step,omitempty" bson:"step,omitempty"`
+	Error         string     `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt     *time.Time `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	CompletedAt   *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt,omitempty"`
+	// InviteExpiresAt is when the last invite of the owner expires. The
+	// invite itself is only handed out once, see provisioning.InviteOwner.
+	InviteExpiresAt *time.Time `json:"inviteExpiresAt,omitempty" bson:"inviteExpiresAt,omitempty"`
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+var (
+	colorPattern    = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	localePattern   = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// BrandSettings is how a brand presents itself. It is public, except for
+// the email sender.
+type BrandSettings struct {
+	LogoURL     string      `json:"logoUrl,omitempty" bson:"logoUrl,omitempty"`
+	FaviconURL  string      `json:"faviconUrl,omitempty" bson:"faviconUrl,omitempty"`
+	Colors      BrandColors `json:"colors" bson:"colors"`
+	EmailSender EmailSender `json:"emailSender" bson:"emailSender"`
+	// Locale is a BCP 47 tag such as "en" or "fr-CA".
+	Locale string `json:"locale" bson:"locale"`
+	// Timezone is an IANA name such as "Europe/Paris".
+	Timezone string `json:"timezone" bson:"timezone"`
+	// Currency is an ISO 4217 code.
+	Currency string     `json:"currency" bson:"currency"`
+	Legal    LegalLinks `json:"legal" bson:"legal"`
+}
+
+// BrandColors are "#rrggbb" hex colours.
+type BrandColors struct {
+	Primary   string `json:"primary,omitempty" bson:"primary,omitempty"`
+	Secondary string `json:"secondary,omitempty" bson:"secondary,omitempty"`
+	Accent    string `json:"accent,omitempty" bson:"accent,omitempty"`
+}
+
+// EmailSender is who the emails sent on behalf of the brand are from.
+type EmailSender struct {
+	Name    string `json:"name,omitempty" bson:"name,omitempty"`
+	Address string `json:"address,omitempty" bson:"address,omitempty"`
+	ReplyTo string `json:"replyTo,omitempty" bson:"replyTo,omitempty"`
+}
+
+type LegalLinks struct {
+	TermsURL   string `json:"termsUrl,omitempty" bson:"termsUrl,omitempty"`
+	PrivacyURL string `json:"privacyUrl,omitempty" bson:"privacyUrl,omitempty"`
+	ImprintURL string `json:"imprintUrl,omitempty" bson:"imprintUrl,omitempty"`
+}
+
+// DefaultBrandSettings are given to brands created without settings.
+func DefaultBrandSettings() BrandSettings {
+	return BrandSettings{
+		Colors: BrandColors{
+			Primary:   "#1f6feb",
+			Secondary: "#6e7781",
+			Accent:    "#bf3989",
+		},
+		Locale:   "en",
+		Timezone: "UTC",
+		Currency: "USD",
+	}
+}
+
+// WithDefaults fills in the fields left empty from DefaultBrandSettings.
+func (s BrandSettings) WithDefaults() BrandSettings {
+	defaults := DefaultBrandSettings()
+
+	fill := func(value *string, fallback string) {
+		if len(*value) == 0 {
+			*value = fallback
+		}
+	}
+
+	fill(&s.Colors.Primary, defaults.Colors.Primary)
+	fill(&s.Colors.Secondary, defaults.Colors.Secondary)
+	fill(&s.Colors.Accent, defaults.Colors.Accent)
+	fill(&s.Locale, defaults.Locale)
+	fill(&s.Timezone, defaults.Timezone)
+	fill(&s.Currency, defaults.Currency)
+
+	return s
+}
+
+// Location is the brand's timezone.
+func (s BrandSettings) Location() *time.Location {
+	location, err := time.LoadLocation(s.WithDefaults().Timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+// Validate checks the fields that are set; empty ones use the defaults.
+func (s BrandSettings) Validate() error {
+	links := map[string]string{
+		"logoUrl":          s.LogoURL,
+		"faviconUrl":       s.FaviconURL,
+		"legal.termsUrl":   s.Legal.TermsURL,
+		"legal.privacyUrl": s.Legal.PrivacyURL,
+		"legal.imprintUrl": s.Legal.ImprintURL,
+	}
+	for name, link := range links {
+		if len(link) == 0 {
+			continue
+		}
+
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.Scheme != "https" || len(parsed.Host) == 0 {
+			return fmt.Errorf("settings.%s must be an https URL", name)
+		}
+	}
+
+	colors := map[string]string{
+		"primary":   s.Colors.Primary,
+		"secondary": s.Colors.Secondary,
+		"accent":    s.Colors.Accent,
+	}
+	for name, color := range colors {
+		if len(color) > 0 && !colorPattern.MatchString(color) {
+			return fmt.Errorf("settings.colors.%s must be a #rrggbb colour", name)
+		}
+	}
+
+	for _, address := range []string{s.EmailSender.Address, s.EmailSender.ReplyTo} {
+		if len(address) > 0 && !strings.Contains(address, "@") {
+			return errors.New("settings.emailSender addresses must be valid email addresses")
+		}
+	}
+
+	if len(s.Locale) > 0 && !localePattern.MatchString(s.Locale) {
+		return errors.New("settings.locale must be a language tag such as en or fr-CA")
+	}
+
+	if len(s.Currency) > 0 && !currencyPattern.MatchString(s.Currency) {
+		return errors.New("settings.currency must be an ISO 4217 code such as USD")
+	}
+
+	if len(s.Timezone) > 0 {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return errors.New("settings.timezone must be an IANA timezone such as Europe/Paris")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"white-label-crm/database"
+)
+
+var flagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// FeatureFlag turns a feature on for some brands, or some of their users,
+// without a deploy. Flags live in the system database.
+type FeatureFlag struct {
+	database.Model `bson:",inline"`
+
+	// Key is what the code checks the flag by.
+	Key         string `json:"key" bson:"key" access:"immutable"`
+	Description string `json:"description" bson:"description" access:"writable"`
+	// Enabled switches the flag off everywhere when unset, whatever the
+	// percentages.
+	Enabled bool `json:"enabled" bson:"enabled" access:"writable"`
+	// Percentage of users the flag is on for, on brands not listed in
+	// Brands.
+	Percentage int `json:"percentage" bson:"percentage" access:"writable"`
+	// Brands overrides Percentage by brand slug. 0 keeps the flag off for
+	// the brand, 100 turns it on for all its users.
+	Brands map[string]int `json:"brands,omitempty" bson:"brands,omitempty" access:"writable"`
+}
+
+func (f *FeatureFlag) GetCollectionName() string { return "feature_flags" }
+
+func (f *FeatureFlag) Indexes() []database.Index {
+	return []database.Index{
+		database.LiveUnique("key"),
+		database.TrashIndex(),
+	}
+}
+
+func (f *FeatureFlag) Validate() error {
+	if !flagKeyPattern.MatchString(f.Key) {
+		return errors.New("key must be lowercase letters, digits, dots, dashes and underscores, up to 64 characters")
+	}
+
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return errors.New("percentage must be between 0 and 100")
+	}
+
+	for slug, percentage := range f.Brands {
+		if percentage < 0 || percentage > 100 {
+			return fmt.Errorf("percentage of brand %q must be between 0 and 100", slug)
+		}
+	}
+
+	return nil
+}
+
+// EnabledFor evaluates the flag for a brand and a subject, which is the
+// user ID or, without a user, the brand ID. A subject keeps the same answer
+// as the percentage grows, and flags are rolled out to different subjects
+// first.
+func (f *FeatureFlag) EnabledFor(brandSlug string, subject string) bool {
+	if !f.Enabled {
+		return false
+	}
+
+	percentage := f.Percentage
+	if override, ok := f.Brands[brandSlug]; ok {
+		percentage = override
+	}
+
+	if percentage <= 0 {
+		return false
+	}
+
+	if percentage >= 100 {
+		return true
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(f.Key + ":" + subject))
+
+	return int(hash.Sum32()%100) < percentage
+}
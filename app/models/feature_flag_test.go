@@ -0,0 +1,134 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFeatureFlagEnabledFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		flag  FeatureFlag
+		brand string
+		want  bool
+	}{
+		{
+			name:  "disabled ignores percentages",
+			flag:  FeatureFlag{Key: "beta", Percentage: 100, Brands: map[string]int{"acme": 100}},
+			brand: "acme",
+			want:  false,
+		},
+		{
+			name:  "zero percent",
+			flag:  FeatureFlag{Key: "beta", Enabled: true},
+			brand: "acme",
+			want:  false,
+		},
+		{
+			name:  "hundred percent",
+			flag:  FeatureFlag{Key: "beta", Enabled: true, Percentage: 100},
+			brand: "acme",
+			want:  true,
+		},
+		{
+			name:  "brand override of zero",
+			flag:  FeatureFlag{Key: "beta", Enabled: true, Percentage: 100, Brands: map[string]int{"acme": 0}},
+			brand: "acme",
+			want:  false,
+		},
+		{
+			name:  "brand override of hundred",
+			flag:  FeatureFlag{Key: "beta", Enabled: true, Brands: map[string]int{"acme": 100}},
+			brand: "acme",
+			want:  true,
+		},
+		{
+			name:  "other brands keep the percentage",
+			flag:  FeatureFlag{Key: "beta", Enabled: true, Brands: map[string]int{"acme": 100}},
+			brand: "globex",
+			want:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				subject := fmt.Sprintf("user-%d", i)
+				if got := tt.flag.EnabledFor(tt.brand, subject); got != tt.want {
+					t.Fatalf("EnabledFor(%q, %q) = %v, want %v", tt.brand, subject, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFeatureFlagBucketing(t *testing.T) {
+	const subjects = 1000
+
+	flag := FeatureFlag{Key: "beta", Enabled: true}
+	enabled := make([]bool, subjects)
+
+	for percentage := 1; percentage < 100; percentage++ {
+		flag.Percentage = percentage
+
+		count := 0
+		for i := range enabled {
+			subject := fmt.Sprintf("user-%d", i)
+			got := flag.EnabledFor("acme", subject)
+			if got != flag.EnabledFor("acme", subject) {
+				t.Fatalf("EnabledFor(%q) changed between calls at %d%%", subject, percentage)
+			}
+
+			// Growing the rollout never turns the flag off for a subject.
+			if enabled[i] && !got {
+				t.Fatalf("EnabledFor(%q) turned off going to %d%%", subject, percentage)
+			}
+
+			enabled[i] = got
+			if got {
+				count++
+			}
+		}
+
+		if want := subjects * percentage / 100; count < want-60 || count > want+60 {
+			t.Errorf("%d%% enabled the flag for %d of %d subjects", percentage, count, subjects)
+		}
+	}
+
+	// Another key buckets the same subjects differently.
+	other := FeatureFlag{Key: "gamma", Enabled: true, Percentage: 50}
+	flag.Percentage = 50
+
+	same := true
+	for i := 0; i < subjects && same; i++ {
+		subject := fmt.Sprintf("user-%d", i)
+		same = flag.EnabledFor("acme", subject) == other.EnabledFor("acme", subject)
+	}
+
+	if same {
+		t.Error("flags with different keys rolled out to the same subjects")
+	}
+}
+
+func TestFeatureFlagValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    FeatureFlag
+		wantErr bool
+	}{
+		{name: "valid", flag: FeatureFlag{Key: "new.dashboard_v2", Percentage: 50, Brands: map[string]int{"acme": 100}}},
+		{name: "uppercase key", flag: FeatureFlag{Key: "Beta"}, wantErr: true},
+		{name: "empty key", flag: FeatureFlag{}, wantErr: true},
+		{name: "negative percentage", flag: FeatureFlag{Key: "beta", Percentage: -1}, wantErr: true},
+		{name: "percentage above hundred", flag: FeatureFlag{Key: "beta", Percentage: 101}, wantErr: true},
+		{name: "brand percentage above hundred", flag: FeatureFlag{Key: "beta", Brands: map[string]int{"acme": 101}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.flag.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"white-label-crm/database"
+)
+
+// BrandModels are stored in every brand database.
+func BrandModels() []database.IndexedModel {
+	return []database.IndexedModel{
+		&User{},
+		&Role{},
+		&Pipeline{},
+	}
+}
+
+// SystemModels are stored in the system database.
+func SystemModels() []database.IndexedModel {
+	return []database.IndexedModel{
+		&Brand{},
+		&SigningKey{},
+		&FeatureFlag{},
+		&BrandUsage{},
+		// Administrators of the admin API
+		&User{},
+		&Role{},
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"white-label-crm/database"
+)
+
+// Pipeline is a sales process deals move through, stage by stage.
+type Pipeline struct {
+	database.Model `bson:",inline"`
+
+	Name   string          `json:"name" bson:"name" access:"writable"`
+	Slug   string          `json:"slug" bson:"slug" access:"immutable"`
+	Stages []PipelineStage `json:"stages" bson:"stages" access:"writable"`
+	// Default is the pipeline new deals are put in.
+	Default bool `json:"default" bson:"default" access:"writable"`
+}
+
+type PipelineStage struct {
+	Name string `json:"name" bson:"name"`
+	Slug string `json:"slug" bson:"slug"`
+	// Probability of winning a deal in this stage, in percent.
+	Probability int `json:"probability" bson:"probability"`
+}
+
+func (p *Pipeline) GetCollectionName() string { return "pipelines" }
+
+func (p *Pipeline) Indexes() []database.Index {
+	return []database.Index{
+		database.LiveUnique("slug"),
+		database.TrashIndex(),
+	}
+}
+
+// DefaultPipelines are seeded into every brand database.
+func DefaultPipelines() []Pipeline {
+	return []Pipeline{
+		{
+			Name: "Sales",
+			Slug: "sales",
+			Stages: []PipelineStage{
+				{Name: "Lead", Slug: "lead", Probability: 10},
+				{Name: "Qualified", Slug: "qualified", Probability: 25},
+				{Name: "Proposal", Slug: "proposal", Probability: 50},
+				{Name: "Negotiation", Slug: "negotiation", Probability: 75},
+				{Name: "Won", Slug: "won", Probability: 100},
+				{Name: "Lost", Slug: "lost", Probability: 0},
+			},
+			Default: true,
+		},
+	}
+}
+
+// Validate requires stage slugs to be unique within the pipeline.
+func (p *Pipeline) Validate() error {
+	seen := map[string]bool{}
+	for _, stage := range p.Stages {
+		if len(stage.Slug) == 0 {
+			return errors.New("stages must have a slug")
+		}
+
+		if seen[stage.Slug] {
+			return fmt.Errorf("stage %q is defined twice", stage.Slug)
+		}
+
+		seen[stage.Slug] = true
+	}
+
+	return nil
+}
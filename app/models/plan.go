@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"white-label-crm/database"
+)
+
+// DefaultPlan is the plan of brands that don't have one.
+const DefaultPlan = "free"
+
+// PlanLimits caps what a brand can use. 0 is unlimited.
+type PlanLimits struct {
+	Users int64 `json:"users" bson:"users"`
+	// Records counts every live record of the brand but its users.
+	Records int64 `json:"records" bson:"records"`
+	// APICalls is per calendar month, in UTC.
+	APICalls     int64 `json:"apiCalls" bson:"apiCalls"`
+	StorageBytes int64 `json:"storageBytes" bson:"storageBytes"`
+}
+
+type Plan struct {
+	Slug   string     `json:"slug"`
+	Name   string     `json:"name"`
+	Limits PlanLimits `json:"limits"`
+}
+
+// Plans are the plans brands can be on, by slug.
+func Plans() map[string]Plan {
+	return map[string]Plan{
+		"free": {
+			Slug: "free",
+			Name: "Free",
+			Limits: PlanLimits{
+				Users:        3,
+				Records:      1_000,
+				APICalls:     10_000,
+				StorageBytes: 100 << 20,
+			},
+		},
+		"pro": {
+			Slug: "pro",
+			Name: "Pro",
+			Limits: PlanLimits{
+				Users:        50,
+				Records:      100_000,
+				APICalls:     1_000_000,
+				StorageBytes: 10 << 30,
+			},
+		},
+		"enterprise": {
+			Slug: "enterprise",
+			Name: "Enterprise",
+		},
+	}
+}
+
+func validatePlan(plan string) error {
+	if len(plan) == 0 {
+		return nil
+	}
+
+	if _, ok := Plans()[plan]; !ok {
+		return fmt.Errorf("plan %q doesn't exist", plan)
+	}
+
+	return nil
+}
+
+// BrandUsage is what a brand used in a month, as last persisted from the
+// counters in Redis.
+type BrandUsage struct {
+	database.Model `bson:",inline"`
+
+	Brand primitive.ObjectID `json:"brand" bson:"brand"`
+	// Period is the month, as "2006-01".
+	Period       string `json:"period" bson:"period"`
+	Users        int64  `json:"users" bson:"users"`
+	Records      int64  `json:"records" bson:"records"`
+	APICalls     int64  `json:"apiCalls" bson:"apiCalls"`
+	StorageBytes int64  `json:"storageBytes" bson:"storageBytes"`
+}
+
+func (u *BrandUsage) GetCollectionName() string { return "brand_usage" }
+
+func (u *BrandUsage) Indexes() []database.Index {
+	return []database.Index{
+		{Keys: bson.D{{Key: "brand", Value: 1}, {Key: "period", Value: -1}}, Unique: true},
+	}
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"white-label-crm/database"
+)
+
+type Role struct {
+	database.Model `bson:",inline"`
+
+	Name        string   `json:"name" bson:"name" access:"writable"`
+	Slug        string   `json:"slug" bson:"slug" access:"immutable"`
+	Description string   `json:"description" bson:"description" access:"writable"`
+	Permissions []string `json:"permissions" bson:"permissions" access:"writable"`
+	// System roles are created for every brand and cannot be removed.
+	System bool `json:"system" bson:"system"`
+}
+
+func (r *Role) GetCollectionName() string { return "roles" }
+
+func (r *Role) Indexes() []database.Index {
+	return []database.Index{
+		// Roles are referenced by slug from users.
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Unique: true},
+	}
+}
+
+// OwnerRole is the slug of the role with full access to a brand. Only
+// owners can give it to, or take it from, other users.
+const OwnerRole = "owner"
+
+// RegisteredRole is the slug of the role given to users who register
+// themselves. It grants nothing until an admin assigns more roles.
+const RegisteredRole = "registered"
+
+// DefaultRoles are seeded into every brand database.
+func DefaultRoles() []Role {
+	return []Role{
+		{
+			Name:        "Owner",
+			Slug:        OwnerRole,
+			Description: "Full access to the brand.",
+			Permissions: []string{"*"},
+			System:      true,
+		},
+		{
+			Name:        "Administrator",
+			Slug:        "admin",
+			Description: "Manage users, roles and pipelines.",
+			Permissions: []string{"users.*", "roles.*", "pipelines.*"},
+			System:      true,
+		},
+		{
+			Name:        "Member",
+			Slug:        "member",
+			Description: "Read-only access to users and pipelines.",
+			Permissions: []string{"users.read", "pipelines.read"},
+			System:      true,
+		},
+		{
+			Name:        "Registered",
+			Slug:        RegisteredRole,
+			Description: "Signed up without being given any access yet.",
+			Permissions: []string{},
+			System:      true,
+		},
+	}
+}
+
+// SuperAdminRole is given to the administrators of the admin API, in the
+// system database.
+func SuperAdminRole() Role {
+	return Role{
+		Name:        "Super administrator",
+		Slug:        "superadmin",
+		Description: "Manage every brand.",
+		Permissions: []string{"*"},
+		System:      true,
+	}
+}
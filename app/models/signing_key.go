@@ -0,0 +1,31 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"white-label-crm/database"
+)
+
+// SigningKey is stored in the system database. A brand may have several
+// keys so they can be rotated; only the active one is used for signing but
+// all of them are accepted for verification.
+type SigningKey struct {
+	database.Model `bson:",inline"`
+
+	BrandID    primitive.ObjectID `json:"brandId" bson:"brandId"`
+	KeyID      string             `json:"kid" bson:"kid"`
+	Algorithm  string             `json:"algorithm" bson:"algorithm"`
+	Secret     []byte             `json:"-" bson:"secret,omitempty"`
+	PrivateKey []byte             `json:"-" bson:"privateKey,omitempty"`
+	PublicKey  []byte             `json:"publicKey,omitempty" bson:"publicKey,omitempty"`
+	Active     bool               `json:"active" bson:"active"`
+}
+
+func (k *SigningKey) GetCollectionName() string { return "signing_keys" }
+
+func (k *SigningKey) Indexes() []database.Index {
+	return []database.Index{
+		{Keys: bson.D{{Key: "brandId", Value: 1}, {Key: "kid", Value: 1}}, Unique: true},
+		{Keys: bson.D{{Key: "brandId", Value: 1}, {Key: "active", Value: 1}}},
+	}
+}
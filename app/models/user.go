@@ -1,15 +1,44 @@
 package models
 
 import (
+	"errors"
+	"strings"
 	"white-label-crm/database"
 )
 
 type User struct {
 	database.Model `bson:",inline"`
 
-	Name     string `json:"name" bson:"name"`
-	Email    string `json:"email" bson:"email"`
+	Name  string `json:"name" bson:"name" access:"writable"`
+	Email string `json:"email" bson:"email" access:"writable"`
+	// Password is an argon2id hash, only written by the password endpoint.
 	Password string `json:"-" bson:"password"`
+	// Roles are granted with the "users.admin" permission or through the
+	// role assignment endpoint.
+	Roles []string `json:"roles" bson:"roles" access:"admin"`
 }
 
 func (u *User) GetCollectionName() string { return "users" }
+
+func (u *User) Relation() database.UserRelation {
+	return database.UserRelation{
+		ID:   u.ID,
+		Name: u.Name,
+	}
+}
+
+func (u *User) Validate() error {
+	if !strings.Contains(u.Email, "@") {
+		return errors.New("email must be a valid email address")
+	}
+
+	return nil
+}
+
+func (u *User) Indexes() []database.Index {
+	return []database.Index{
+		// Login looks users up by email, and it identifies them.
+		database.LiveUnique("email"),
+		database.TrashIndex(),
+	}
+}
@@ -0,0 +1,278 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"reflect"
+	"strings"
+	"sync"
+	"white-label-crm/app/middleware/rbac"
+	"white-label-crm/database"
+)
+
+// Access is declared on model fields with the `access` struct tag, e.g.
+// `access:"writable"`. Fields without the tag are read-only.
+type Access string
+
+const (
+	// AccessHidden fields are never read or written through the API.
+	AccessHidden Access = "hidden"
+	// AccessReadOnly fields are readable by everyone but never writable.
+	AccessReadOnly Access = "readonly"
+	// AccessWritable fields are readable and writable by everyone.
+	AccessWritable Access = "writable"
+	// AccessImmutable fields are readable and can only be set on creation.
+	AccessImmutable Access = "immutable"
+	// AccessAdmin fields are only readable and writable by admins.
+	AccessAdmin Access = "admin"
+)
+
+type Field struct {
+	Name   string
+	JSON   string
+	BSON   string
+	Access Access
+	Type   reflect.Type
+	index  []int
+}
+
+type Policy struct {
+	fields []Field
+}
+
+type ForbiddenFieldError struct {
+	Field string
+}
+
+func (e *ForbiddenFieldError) Error() string {
+	return fmt.Sprintf("field %q is not writable", e.Field)
+}
+
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q", e.Field)
+}
+
+type InvalidValueError struct {
+	Field string
+	Err   error
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid value for %q: %v", e.Field, e.Err)
+}
+
+func (e *InvalidValueError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	policies   = map[reflect.Type]*Policy{}
+	policiesMu sync.RWMutex
+)
+
+// For returns the (cached) policy of a model struct or pointer to one.
+func For(model interface{}) *Policy {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	policiesMu.RLock()
+	p, ok := policies[t]
+	policiesMu.RUnlock()
+	if ok {
+		return p
+	}
+
+	p = &Policy{fields: collectFields(t, nil)}
+
+	policiesMu.Lock()
+	policies[t] = p
+	policiesMu.Unlock()
+
+	return p
+}
+
+// IsAdmin reports whether the current user bypasses admin-only fields of
+// the model, which is granted by the "<collection>.admin" permission.
+func IsAdmin(ctx *fiber.Ctx, model database.CollectionModel) bool {
+	return rbac.Can(ctx, model.GetCollectionName()+".admin")
+}
+
+// Fields returns every field of the model.
+func (p *Policy) Fields() []Field {
+	return p.fields
+}
+
+// Lookup finds a field by its Go, JSON or BSON name.
+func (p *Policy) Lookup(name string) (Field, bool) {
+	for _, f := range p.fields {
+		if f.JSON == name || f.BSON == name || f.Name == name {
+			return f, true
+		}
+	}
+
+	return Field{}, false
+}
+
+// Writable resolves the field that a request wants to write to, returning
+// an *UnknownFieldError or *ForbiddenFieldError when it can't.
+func (p *Policy) Writable(name string, admin bool, creating bool) (Field, error) {
+	f, ok := p.Lookup(name)
+	if !ok {
+		return Field{}, &UnknownFieldError{Field: name}
+	}
+
+	if !f.CanWrite(admin, creating) {
+		return Field{}, &ForbiddenFieldError{Field: f.JSON}
+	}
+
+	return f, nil
+}
+
+func (f Field) CanRead(admin bool) bool {
+	switch f.Access {
+	case AccessHidden:
+		return false
+	case AccessAdmin:
+		return admin
+	default:
+		return true
+	}
+}
+
+func (f Field) CanWrite(admin bool, creating bool) bool {
+	switch f.Access {
+	case AccessWritable:
+		return true
+	case AccessImmutable:
+		return creating
+	case AccessAdmin:
+		return admin
+	default:
+		return false
+	}
+}
+
+// Decode converts a value decoded from a JSON body (float64, map, ...)
+// into the field's Go type.
+func (f Field) Decode(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, &InvalidValueError{Field: f.JSON, Err: err}
+	}
+
+	out := reflect.New(f.Type)
+	if err := json.Unmarshal(raw, out.Interface()); err != nil {
+		return nil, &InvalidValueError{Field: f.JSON, Err: err}
+	}
+
+	return out.Elem().Interface(), nil
+}
+
+// Assign sets the field on a pointer to a record.
+func (f Field) Assign(record interface{}, value interface{}) {
+	target := reflect.ValueOf(record).Elem().FieldByIndex(f.index)
+	if value == nil {
+		target.Set(reflect.Zero(f.Type))
+		return
+	}
+
+	target.Set(reflect.ValueOf(value))
+}
+
+// Filter returns the readable fields of a record keyed by their JSON name.
+func (p *Policy) Filter(record interface{}, admin bool) map[string]interface{} {
+	v := reflect.ValueOf(record)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+
+		v = v.Elem()
+	}
+
+	out := make(map[string]interface{}, len(p.fields))
+	for _, f := range p.fields {
+		if !f.CanRead(admin) {
+			continue
+		}
+
+		out[f.JSON] = v.FieldByIndex(f.index).Interface()
+	}
+
+	return out
+}
+
+// FilterAll applies Filter to every record.
+func FilterAll[T any](records []T, admin bool) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(records))
+	if len(records) == 0 {
+		return out
+	}
+
+	p := For(records[0])
+	for i, record := range records {
+		out[i] = p.Filter(record, admin)
+	}
+
+	return out
+}
+
+func collectFields(t reflect.Type, index []int) []Field {
+	var fields []Field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		// Inline embedded structs such as database.Model.
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, collectFields(sf.Type, fieldIndex)...)
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		jsonName := tagName(sf.Tag.Get("json"), sf.Name)
+		bsonName := tagName(sf.Tag.Get("bson"), strings.ToLower(sf.Name))
+
+		access := Access(sf.Tag.Get("access"))
+		if len(access) == 0 {
+			access = AccessReadOnly
+		}
+
+		if jsonName == "-" {
+			access = AccessHidden
+		}
+
+		fields = append(
+			fields,
+			Field{
+				Name:   sf.Name,
+				JSON:   jsonName,
+				BSON:   bsonName,
+				Access: access,
+				Type:   sf.Type,
+				index:  fieldIndex,
+			},
+		)
+	}
+
+	return fields
+}
+
+func tagName(tag string, fallback string) string {
+	name, _, _ := strings.Cut(tag, ",")
+	if len(name) == 0 {
+		return fallback
+	}
+
+	return name
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testModel struct {
+	Embedded `bson:",inline"`
+
+	Name    string   `json:"name" bson:"name" access:"writable"`
+	Code    string   `json:"code" bson:"code" access:"immutable"`
+	Roles   []string `json:"roles" bson:"roles" access:"admin"`
+	Secret  string   `json:"-" bson:"secret"`
+	Counter int      `json:"counter" bson:"counter"`
+}
+
+type Embedded struct {
+	Owner string `json:"owner" bson:"owner_id" access:"writable"`
+}
+
+func TestWritable(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		admin    bool
+		creating bool
+		want     string
+		err      error
+	}{
+		{name: "writable by json name", field: "name", want: "name"},
+		{name: "writable by go name", field: "Name", want: "name"},
+		{name: "embedded by bson name", field: "owner_id", want: "owner"},
+		{name: "untagged is read-only", field: "counter", err: &ForbiddenFieldError{}},
+		{name: "hidden", field: "secret", err: &ForbiddenFieldError{}},
+		{name: "hidden even for admins", field: "secret", admin: true, err: &ForbiddenFieldError{}},
+		{name: "immutable on update", field: "code", err: &ForbiddenFieldError{}},
+		{name: "immutable on create", field: "code", creating: true, want: "code"},
+		{name: "admin field", field: "roles", err: &ForbiddenFieldError{}},
+		{name: "admin field as admin", field: "roles", admin: true, want: "roles"},
+		{name: "unknown", field: "missing", err: &UnknownFieldError{}},
+	}
+
+	p := For(&testModel{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, err := p.Writable(tt.field, tt.admin, tt.creating)
+
+			switch tt.err.(type) {
+			case *ForbiddenFieldError:
+				var forbidden *ForbiddenFieldError
+				if !errors.As(err, &forbidden) {
+					t.Fatalf("Writable(%q) error = %v, want *ForbiddenFieldError", tt.field, err)
+				}
+			case *UnknownFieldError:
+				var unknown *UnknownFieldError
+				if !errors.As(err, &unknown) {
+					t.Fatalf("Writable(%q) error = %v, want *UnknownFieldError", tt.field, err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("Writable(%q) error = %v", tt.field, err)
+				}
+
+				if field.JSON != tt.want {
+					t.Errorf("Writable(%q) = %q, want %q", tt.field, field.JSON, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		field   string
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "string", field: "name", value: "Jane", want: "Jane"},
+		{name: "float to int", field: "counter", value: float64(3), want: 3},
+		{name: "slice of interfaces", field: "roles", value: []interface{}{"a", "b"}, want: []string{"a", "b"}},
+		{name: "null", field: "roles", value: nil, want: []string(nil)},
+		{name: "number for string", field: "name", value: float64(1), wantErr: true},
+		{name: "fraction for int", field: "counter", value: 1.5, wantErr: true},
+		{name: "object for slice", field: "roles", value: map[string]interface{}{}, wantErr: true},
+	}
+
+	p := For(&testModel{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, ok := p.Lookup(tt.field)
+			if !ok {
+				t.Fatalf("Lookup(%q) found nothing", tt.field)
+			}
+
+			got, err := field.Decode(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Decode(%v) = %v, want an error", tt.value, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Decode(%v) error = %v", tt.value, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode(%v) = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	record := &testModel{
+		Embedded: Embedded{Owner: "o"},
+		Name:     "n",
+		Roles:    []string{"r"},
+		Secret:   "s",
+	}
+
+	p := For(record)
+	if got := p.Filter(record, false); hasKey(got, "roles") || hasKey(got, "-") || !hasKey(got, "owner") {
+		t.Errorf("Filter(admin=false) = %v", got)
+	}
+
+	if got := p.Filter(record, true); !hasKey(got, "roles") || hasKey(got, "-") {
+		t.Errorf("Filter(admin=true) = %v", got)
+	}
+}
+
+func hasKey(m map[string]interface{}, key string) bool {
+	_, ok := m[key]
+	return ok
+}
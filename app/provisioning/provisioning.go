@@ -0,0 +1,371 @@
+package provisioning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/app/session"
+	"white-label-crm/database"
+	"white-label-crm/migrations"
+	"white-label-crm/redis"
+)
+
+const (
+	// MaxAttempts failed runs stop the automatic retries; the provision
+	// command can still be used.
+	MaxAttempts = 5
+	lockTTL     = 5 * time.Minute
+	inviteTTL   = 7 * 24 * time.Hour
+	// A run that hasn't finished by then died along with its instance.
+	staleAfter    = 15 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// Every step must be safe to run again, as a failed provisioning is
+// retried from the start.
+var steps = []struct {
+	name string
+	run  func(ctx context.Context, brand *models.Brand, db *mongo.Database) error
+}{
+	{"migrations", migrate},
+	{"indexes", ensureIndexes},
+	{"settings", seedSettings},
+	{"signing-key", issueSigningKey},
+	{"owner", createOwner},
+}
+
+var (
+	ErrNoOwner     = errors.New("brand has no owner")
+	ErrOwnerActive = errors.New("owner already chose a password")
+)
+
+// Enqueue provisions the brand in the background.
+func Enqueue(id primitive.ObjectID) {
+	go func() {
+		err := Provision(context.Background(), id, false)
+		if err != nil && !errors.Is(err, redis.ErrLocked) {
+			log.Printf("[provisioning.Enqueue] %s | %v\n", id.Hex(), err)
+		}
+	}()
+}
+
+// Provision sets up the brand database: migrations, indexes, default
+// settings, the signing key and the owner account. Progress is recorded on
+// the brand document. Brands that are already provisioned are skipped
+// unless force is set. redis.ErrLocked is returned when another instance is
+// provisioning the brand.
+func Provision(ctx context.Context, id primitive.ObjectID, force bool) error {
+	lock, err := redis.Acquire(ctx, fmt.Sprintf("locks:provisioning:%s", id.Hex()), lockTTL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(context.Background()); err != nil {
+			log.Printf("[provisioning.Provision] %v\n", err)
+		}
+	}()
+
+	brand, err := database.FindOne[models.Brand](
+		database.GetSystemDb(),
+		ctx,
+		bson.M{"_id": id},
+	)
+	if err != nil {
+		return err
+	}
+
+	attempts := 1
+	if brand.Provisioning != nil {
+		if brand.Provisioning.Status == models.ProvisioningReady && !force {
+			return nil
+		}
+
+		attempts = brand.Provisioning.Attempts + 1
+	}
+
+	err = setStatus(
+		ctx,
+		id,
+		bson.M{
+			"provisioning.status":    models.ProvisioningRunning,
+			"provisioning.attempts":  attempts,
+			"provisioning.startedAt": time.Now(),
+		},
+		"provisioning.error",
+		"provisioning.completedAt",
+		"provisioning.nextAttemptAt",
+	)
+	if err != nil {
+		return err
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if err := lock.Extend(ctx, lockTTL); err != nil {
+			return err
+		}
+
+		if err := setStatus(ctx, id, bson.M{"provisioning.step": step.name}); err != nil {
+			return err
+		}
+
+		log.Printf("[provisioning.Provision] %s | %s\n", brand.Slug, step.name)
+		if err := step.run(ctx, brand, db); err != nil {
+			fail(ctx, id, attempts, err)
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+
+	return setStatus(
+		ctx,
+		id,
+		bson.M{
+			"provisioning.status":      models.ProvisioningReady,
+			"provisioning.completedAt": time.Now(),
+		},
+		"provisioning.step",
+	)
+}
+
+// fail records the error and when the next attempt is due, leaving the
+// failed step in place.
+func fail(ctx context.Context, id primitive.ObjectID, attempts int, cause error) {
+	set := bson.M{
+		"provisioning.status": models.ProvisioningFailed,
+		"provisioning.error":  cause.Error(),
+	}
+
+	if attempts < MaxAttempts {
+		set["provisioning.nextAttemptAt"] = time.Now().Add(backoff(attempts))
+	}
+
+	if err := setStatus(ctx, id, set); err != nil {
+		log.Printf("[provisioning.fail] %v\n", err)
+	}
+}
+
+// backoff doubles the delay after each failed attempt: 30s, 1m, 2m, ...
+func backoff(attempts int) time.Duration {
+	return 30 * time.Second << (attempts - 1)
+}
+
+func setStatus(ctx context.Context, id primitive.ObjectID, set bson.M, unset ...string) error {
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, field := range unset {
+			fields[field] = ""
+		}
+
+		update["$unset"] = fields
+	}
+
+	_, err := database.GetSystemDb().Collection((&models.Brand{}).GetCollectionName()).
+		UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+// Due lists the brands waiting to be provisioned: new ones, failed ones
+// whose next attempt is due and runs that were abandoned.
+func Due(ctx context.Context) ([]primitive.ObjectID, error) {
+	now := time.Now()
+	cursor, err := database.GetSystemDb().Collection((&models.Brand{}).GetCollectionName()).Find(
+		ctx,
+		bson.M{
+			"deletedAt": bson.M{"$exists": false},
+			"$or": bson.A{
+				bson.M{"provisioning.status": models.ProvisioningPending},
+				bson.M{
+					"provisioning.status":        models.ProvisioningFailed,
+					"provisioning.nextAttemptAt": bson.M{"$lte": now},
+				},
+				bson.M{
+					"provisioning.status":    models.ProvisioningRunning,
+					"provisioning.startedAt": bson.M{"$lte": now.Add(-staleAfter)},
+				},
+			},
+		},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var brands []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &brands); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(brands))
+	for i, brand := range brands {
+		ids[i] = brand.ID
+	}
+
+	return ids, nil
+}
+
+// Start periodically provisions the brands that are due, until the
+// returned function is called.
+func Start() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			ids, err := Due(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[provisioning.Start] %v\n", err)
+			}
+
+			for _, id := range ids {
+				err := Provision(ctx, id, false)
+				if err != nil && !errors.Is(err, redis.ErrLocked) && ctx.Err() == nil {
+					log.Printf("[provisioning.Start] %s | %v\n", id.Hex(), err)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return cancel
+}
+
+func migrate(ctx context.Context, brand *models.Brand, db *mongo.Database) error {
+	_, err := migrations.Migrate(ctx, db, migrations.ScopeBrand, migrations.Options{})
+	return err
+}
+
+func ensureIndexes(ctx context.Context, brand *models.Brand, db *mongo.Database) error {
+	report, err := database.EnsureIndexes(ctx, db, models.BrandModels(), database.IndexOptions{})
+	if err != nil {
+		return err
+	}
+
+	database.LogIndexReport(report)
+	return errors.Join(report.Errors...)
+}
+
+// seedSettings gives the brand the default settings unless it was created
+// with its own.
+func seedSettings(ctx context.Context, brand *models.Brand, db *mongo.Database) error {
+	_, err := database.GetSystemDb().Collection(brand.GetCollectionName()).UpdateOne(
+		ctx,
+		bson.M{"_id": brand.ID, "settings": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"settings": models.DefaultBrandSettings()}},
+	)
+	return err
+}
+
+// issueSigningKey gives the brand the key its access tokens are signed
+// with.
+func issueSigningKey(ctx context.Context, brand *models.Brand, db *mongo.Database) error {
+	_, err := session.EnsureSigningKey(ctx, brand.ID, session.DefaultSigningAlgorithm)
+	return err
+}
+
+// createOwner creates the owner's account without a password. They choose
+// one through the link of InviteOwner.
+func createOwner(ctx context.Context, brand *models.Brand, db *mongo.Database) error {
+	if brand.Owner == nil {
+		return nil
+	}
+
+	_, err := findOwner(ctx, brand, db)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	now := time.Now()
+	owner := models.User{
+		Model: database.Model{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: now,
+			UpdatedAt: now,
+			UpdatedBy: database.SystemUser,
+			Version:   1,
+		},
+		Name:  brand.Owner.Name,
+		Email: brand.Owner.Email,
+		Roles: []string{models.OwnerRole},
+	}
+
+	_, err = db.Collection(owner.GetCollectionName()).InsertOne(ctx, owner)
+	return err
+}
+
+// InviteOwner issues the link letting the brand's owner choose their
+// password, revoking any earlier one. The link is only returned here, for
+// the caller to hand over; like the token it carries, it is never stored,
+// only its expiry is.
+func InviteOwner(ctx context.Context, id primitive.ObjectID) (string, time.Time, error) {
+	brand, err := database.FindOne[models.Brand](database.GetSystemDb(), ctx, bson.M{"_id": id})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if brand.Owner == nil {
+		return "", time.Time{}, ErrNoOwner
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	owner, err := findOwner(ctx, brand, db)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", time.Time{}, ErrNoOwner
+	}
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if len(owner.Password) > 0 {
+		return "", time.Time{}, ErrOwnerActive
+	}
+
+	token, err := session.CreateInvite(ctx, db.Name(), owner.ID, inviteTTL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(inviteTTL)
+	if err := setStatus(ctx, brand.ID, bson.M{"provisioning.inviteExpiresAt": expiresAt}); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return fmt.Sprintf("https://%s/invite?token=%s", brand.CanonicalDomain, token), expiresAt, nil
+}
+
+func findOwner(ctx context.Context, brand *models.Brand, db *mongo.Database) (*models.User, error) {
+	var owner models.User
+	err := db.Collection(owner.GetCollectionName()).
+		FindOne(ctx, bson.M{"email": brand.Owner.Email, "deletedAt": bson.M{"$exists": false}}).
+		Decode(&owner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &owner, nil
+}
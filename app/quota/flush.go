@@ -0,0 +1,175 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/redis"
+)
+
+const flushInterval = 5 * time.Minute
+
+// Flush recounts what every brand uses, which corrects the drift of the
+// counters in Redis, and persists it to `system.brand_usage` along with
+// the API calls of the month. Only one instance flushes per interval:
+// redis.ErrLocked is returned on the others.
+func Flush(ctx context.Context) error {
+	// Not released, so the lock expiring is what lets the next flush run.
+	if _, err := redis.Acquire(ctx, "locks:usage", flushInterval-time.Second); err != nil {
+		return err
+	}
+
+	brands, err := database.Find[models.Brand](database.GetSystemDb(), ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, brand := range brands {
+		if err := flushBrand(ctx, brand); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func flushBrand(ctx context.Context, brand *models.Brand) error {
+	db, err := brand.Db()
+	if err != nil {
+		return err
+	}
+
+	usage, err := count(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	id := brand.ID.Hex()
+	now := time.Now()
+
+	_, err = redis.Client.HSet(
+		ctx,
+		usageKey(id),
+		string(Users), usage.Users,
+		string(Records), usage.Records,
+		string(Storage), usage.StorageBytes,
+	).Result()
+	if err != nil {
+		return err
+	}
+
+	// The previous month is persisted once more, for the calls made since
+	// its last flush.
+	current := Period(now)
+	previous := Period(now.UTC().AddDate(0, 0, -now.UTC().Day()))
+	for _, period := range []string{previous, current} {
+		calls, err := redis.Client.Get(ctx, apiCallsKey(id, period)).Int64()
+		if errors.Is(err, redis2.Nil) {
+			if period == previous {
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+
+		update := bson.M{"apiCalls": calls}
+		if period == current {
+			update["users"] = usage.Users
+			update["records"] = usage.Records
+			update["storageBytes"] = usage.StorageBytes
+		}
+
+		if err := persist(ctx, brand.ID, period, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// count measures what is stored in the brand database.
+func count(ctx context.Context, db *mongo.Database) (models.BrandUsage, error) {
+	var usage models.BrandUsage
+	live := bson.M{"deletedAt": bson.M{"$exists": false}}
+
+	for _, model := range models.BrandModels() {
+		n, err := db.Collection(model.GetCollectionName()).CountDocuments(ctx, live)
+		if err != nil {
+			return usage, err
+		}
+
+		if ForCollection(model.GetCollectionName()) == Users {
+			usage.Users += n
+		} else {
+			usage.Records += n
+		}
+	}
+
+	var stats struct {
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	err := db.RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}, {Key: "scale", Value: 1}}).Decode(&stats)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.StorageBytes = int64(stats.StorageSize + stats.IndexSize)
+	return usage, nil
+}
+
+func persist(ctx context.Context, brand primitive.ObjectID, period string, update bson.M) error {
+	now := time.Now()
+	update["updatedAt"] = now
+
+	_, err := database.GetSystemDb().Collection((&models.BrandUsage{}).GetCollectionName()).UpdateOne(
+		ctx,
+		bson.M{"brand": brand, "period": period},
+		bson.M{
+			"$set": update,
+			"$setOnInsert": bson.M{
+				"_id":       primitive.NewObjectID(),
+				"createdAt": now,
+				"updatedBy": database.SystemUser,
+				"version":   1,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Start flushes the usage of every brand periodically until the returned
+// function is called.
+func Start() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		for {
+			err := Flush(ctx)
+			if err != nil && !errors.Is(err, redis.ErrLocked) && ctx.Err() == nil {
+				log.Printf("[quota.Start] %v\n", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return cancel
+}
@@ -0,0 +1,175 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	redis2 "github.com/redis/go-redis/v9"
+	"log"
+	"strconv"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/redis"
+)
+
+// Resource is something the plans of brands limit.
+type Resource string
+
+const (
+	Users    Resource = "users"
+	Records  Resource = "records"
+	APICalls Resource = "apiCalls"
+	Storage  Resource = "storage"
+)
+
+// API call counters outlive their month so the last one can be persisted.
+const apiCallsTTL = 40 * 24 * time.Hour
+
+// ExceededError is returned when the brand reached one of its limits.
+type ExceededError struct {
+	Resource Resource
+	Limit    int64
+	// RetryAfter is when the limit resets, for the ones that do.
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("the %s limit of %d of the plan is reached", e.Resource, e.Limit)
+}
+
+// usageKey is a hash of the users, records and storage the brand uses.
+func usageKey(brandID string) string {
+	return fmt.Sprintf("usage:%s", brandID)
+}
+
+func apiCallsKey(brandID string, period string) string {
+	return fmt.Sprintf("usage:%s:apiCalls:%s", brandID, period)
+}
+
+// Period is the month usage is counted for, as "2006-01".
+func Period(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func nextPeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// CountAPICall counts a request of the brand, returning an *ExceededError
+// once it made more than its plan allows this month.
+func CountAPICall(ctx context.Context, brand models.Brand) error {
+	now := time.Now()
+	key := apiCallsKey(brand.ID.Hex(), Period(now))
+
+	var count *redis2.IntCmd
+	_, err := redis.Client.Pipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			count = pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, apiCallsTTL)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	limit := brand.EffectiveLimits().APICalls
+	if limit > 0 && count.Val() > limit {
+		return &ExceededError{Resource: APICalls, Limit: limit, RetryAfter: nextPeriod(now).Sub(now)}
+	}
+
+	return nil
+}
+
+// Check returns an *ExceededError when the brand of the request can't have
+// one more of the resource, or has used up its storage. Requests without a
+// brand, such as those of the admin API, aren't limited. Usage that can't
+// be read doesn't block anyone.
+func Check(ctx *fiber.Ctx, resource Resource) error {
+	brand, ok := ctx.Locals("brand").(models.Brand)
+	if !ok {
+		return nil
+	}
+
+	values, err := redis.Client.HMGet(ctx.UserContext(), usageKey(brand.ID.Hex()), string(resource), string(Storage)).Result()
+	if err != nil {
+		log.Printf("[quota.Check] %v\n", err)
+		return nil
+	}
+
+	used := func(value interface{}) int64 {
+		str, _ := value.(string)
+		n, _ := strconv.ParseInt(str, 10, 64)
+		return n
+	}
+
+	limits := brand.EffectiveLimits()
+
+	limit := int64(0)
+	switch resource {
+	case Users:
+		limit = limits.Users
+	case Records:
+		limit = limits.Records
+	}
+
+	if limit > 0 && used(values[0]) >= limit {
+		return &ExceededError{Resource: resource, Limit: limit}
+	}
+
+	if limits.StorageBytes > 0 && used(values[1]) >= limits.StorageBytes {
+		return &ExceededError{Resource: Storage, Limit: limits.StorageBytes}
+	}
+
+	return nil
+}
+
+// Track adds delta to what the brand of the request uses of the resource,
+// until the next flush recounts it.
+func Track(ctx *fiber.Ctx, resource Resource, delta int64) {
+	brand, ok := ctx.Locals("brand").(models.Brand)
+	if !ok {
+		return
+	}
+
+	err := redis.Client.HIncrBy(ctx.UserContext(), usageKey(brand.ID.Hex()), string(resource), delta).Err()
+	if err != nil {
+		log.Printf("[quota.Track] %v\n", err)
+	}
+}
+
+// ForCollection is the resource records of the collection count against.
+func ForCollection(collection string) Resource {
+	if collection == (&models.User{}).GetCollectionName() {
+		return Users
+	}
+
+	return Records
+}
+
+// SendExceeded answers a request refused by Check or CountAPICall: 429
+// until the API calls reset, 402 for the limits only a better plan lifts.
+func SendExceeded(ctx *fiber.Ctx, err error) error {
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) {
+		return err
+	}
+
+	status := fiber.StatusPaymentRequired
+	if exceeded.RetryAfter > 0 {
+		status = fiber.StatusTooManyRequests
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(exceeded.RetryAfter.Seconds())))
+	}
+
+	return ctx.Status(status).JSON(
+		fiber.Map{
+			"error":    "quota exceeded",
+			"reason":   exceeded.Error(),
+			"resource": exceeded.Resource,
+			"limit":    exceeded.Limit,
+		},
+	)
+}
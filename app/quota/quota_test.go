@@ -0,0 +1,95 @@
+package quota
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		want string
+	}{
+		{name: "mid month", time: time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), want: "2024-03"},
+		{name: "first instant", time: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), want: "2024-03"},
+		{name: "last instant", time: time.Date(2024, 3, 31, 23, 59, 59, 999999999, time.UTC), want: "2024-03"},
+		// Periods are UTC months, whatever the zone of the time.
+		{name: "ahead of utc", time: time.Date(2024, 4, 1, 1, 0, 0, 0, time.FixedZone("CET", 2*3600)), want: "2024-03"},
+		{name: "behind utc", time: time.Date(2024, 3, 31, 22, 0, 0, 0, time.FixedZone("EST", -5*3600)), want: "2024-04"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Period(tt.time); got != tt.want {
+				t.Errorf("Period(%v) = %q, want %q", tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextPeriod(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		want time.Time
+	}{
+		{name: "mid month", time: time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), want: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "first instant", time: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), want: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "end of year", time: time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC), want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "from january 31st", time: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "ahead of utc", time: time.Date(2024, 4, 1, 1, 0, 0, 0, time.FixedZone("CET", 2*3600)), want: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextPeriod(tt.time)
+			if !got.Equal(tt.want) {
+				t.Errorf("nextPeriod(%v) = %v, want %v", tt.time, got, tt.want)
+			}
+
+			// The next period starts right after the current one ends.
+			if Period(got) == Period(tt.time) || Period(got.Add(-time.Nanosecond)) != Period(tt.time) {
+				t.Errorf("nextPeriod(%v) = %v isn't the start of the following period", tt.time, got)
+			}
+		})
+	}
+}
+
+func TestSendExceeded(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{name: "limit a plan lifts", err: &ExceededError{Resource: Users, Limit: 5}, status: fiber.StatusPaymentRequired},
+		{name: "limit that resets", err: &ExceededError{Resource: APICalls, Limit: 5, RetryAfter: 90 * time.Second}, status: fiber.StatusTooManyRequests, retryAfter: "90"},
+		{name: "other error", err: errors.New("redis down"), status: fiber.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(ctx *fiber.Ctx) error {
+				return SendExceeded(ctx, tt.err)
+			})
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			if got := resp.Header.Get(fiber.HeaderRetryAfter); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
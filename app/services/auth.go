@@ -2,33 +2,75 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"log"
 	"time"
 	"white-label-crm/app/models"
+	"white-label-crm/app/quota"
+	"white-label-crm/app/session"
 	"white-label-crm/database"
 	"white-label-crm/hash"
 	"white-label-crm/utils"
 )
 
 type AuthService struct {
-	limiter *utils.ThroughputLimiter
+	limiter         *utils.ThroughputLimiter
+	sessionOnly     bool
+	sessionTTL      time.Duration
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
 }
 
 type AuthOptions struct {
-	Throughput uint
+	Throughput      uint
+	SessionTTL      time.Duration
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// SessionOnly only exposes login and logout, for APIs whose accounts
+	// can't register themselves and don't use tokens.
+	SessionOnly bool
 }
 
 func NewAuthService(opts *AuthOptions) *AuthService {
-	return &AuthService{
-		limiter: utils.NewThroughputLimiter(opts.Throughput),
+	service := &AuthService{
+		limiter:         utils.NewThroughputLimiter(opts.Throughput),
+		sessionTTL:      opts.SessionTTL,
+		accessTokenTTL:  opts.AccessTokenTTL,
+		refreshTokenTTL: opts.RefreshTokenTTL,
+		sessionOnly:     opts.SessionOnly,
 	}
+
+	if service.sessionTTL == 0 {
+		service.sessionTTL = 24 * time.Hour
+	}
+
+	if service.accessTokenTTL == 0 {
+		service.accessTokenTTL = 15 * time.Minute
+	}
+
+	if service.refreshTokenTTL == 0 {
+		service.refreshTokenTTL = 30 * 24 * time.Hour
+	}
+
+	return service
 }
 
 func (s *AuthService) RegisterRoutes(router *fiber.App) {
 	router.Post("/login", s.login)
+	router.Post("/logout", s.logout)
+	if s.sessionOnly {
+		return
+	}
+
 	router.Post("/register", s.register)
+	router.Post("/token", s.token)
+	router.Post("/token/refresh", s.refreshToken)
+	router.Post("/token/revoke", s.revokeToken)
+	router.Post("/invite/accept", s.acceptInvite)
 }
 
 type loginRequest struct {
@@ -52,28 +94,64 @@ func (s *AuthService) login(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// Find user
-	user, err := database.FindOne[models.User](
-		database.GetBrandDb(ctx),
-		context.TODO(),
-		bson.M{"email": data.Email},
-	)
+	user, err := s.checkCredentials(ctx, data)
 	if err != nil {
 		log.Printf("[AuthService.login] %v\n", err)
 		return ctx.SendStatus(fiber.StatusForbidden)
 	}
 
-	// Check password
-	if err := hash.Compare(data.Password, user.Password); err != nil {
+	// Issue session
+	token, sess, err := session.Create(ctx.UserContext(), database.GetBrandDb(ctx).Name(), user.ID, s.sessionTTL)
+	if err != nil {
 		log.Printf("[AuthService.login] %v\n", err)
-		return ctx.SendStatus(fiber.StatusForbidden)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	// Login success
 	log.Printf("[AuthService.login] Success: %v\n", user)
+	return ctx.JSON(
+		fiber.Map{
+			"token":     token,
+			"expiresAt": sess.ExpiresAt,
+		},
+	)
+}
+
+func (s *AuthService) logout(ctx *fiber.Ctx) error {
+	token, ok := ctx.Locals("sessionToken").(string)
+	if !ok {
+		return ctx.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	if err := session.Revoke(ctx.UserContext(), database.GetBrandDb(ctx).Name(), token); err != nil {
+		log.Printf("[AuthService.logout] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
 	return ctx.SendStatus(fiber.StatusNoContent)
 }
 
+// checkCredentials finds the user by email and verifies their password.
+func (s *AuthService) checkCredentials(ctx *fiber.Ctx, data loginRequest) (*models.User, error) {
+	user, err := database.FindOne[models.User](
+		database.GetBrandDb(ctx),
+		context.TODO(),
+		bson.M{"email": data.Email},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hash.Compare(data.Password, user.Password); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// defaultUserRole is given to every user who registers themselves.
+const defaultUserRole = models.RegisteredRole
+
 type registerRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -95,36 +173,140 @@ func (s *AuthService) register(ctx *fiber.Ctx) error {
 		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
+	if err := quota.Check(ctx, quota.Users); err != nil {
+		return quota.SendExceeded(ctx, err)
+	}
+
 	// Hash password
-	password, err := hash.Hash(
-		data.Password,
-		&hash.Argon2Options{
-			Time:       hash.PasswordTime,
-			Memory:     hash.PasswordMemory,
-			Threads:    hash.PasswordThreads,
-			SaltLength: hash.PasswordSaltLength,
-			KeyLength:  hash.PasswordKeyLength,
-		},
-	)
+	password, err := hash.Password(data.Password)
 	if err != nil {
 		log.Printf("[AuthService.register] %v\n", err)
 		return ctx.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// Create user
-	user := models.User{
-		Model:    database.NewModel(ctx),
-		Email:    data.Email,
-		Password: password,
+	// Create the user along with the role they're given.
+	var user models.User
+	err = database.WithTransaction(
+		ctx,
+		func(tx *database.Tx) error {
+			if err := ensureRole(ctx, tx, defaultUserRole); err != nil {
+				return err
+			}
+
+			user = models.User{
+				Email:    data.Email,
+				Password: password,
+				Roles:    []string{defaultUserRole},
+			}
+
+			_, err := database.NewQuery(ctx).InsertOne(tx, &user)
+			return err
+		},
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return ctx.SendStatus(fiber.StatusConflict)
 	}
 
-	_, err = database.InsertOne[*models.User](database.GetBrandDb(ctx), context.TODO(), &user)
 	if err != nil {
 		log.Printf("[AuthService.register] %v\n", err)
 		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
+	quota.Track(ctx, quota.Users, 1)
+
 	// Registration complete
 	log.Printf("[AuthService.register] Complete: %v\n", user)
 	return ctx.SendStatus(fiber.StatusNoContent)
 }
+
+// ensureRole creates one of the models.DefaultRoles if the brand doesn't
+// have it yet.
+func ensureRole(ctx *fiber.Ctx, tx *database.Tx, slug string) error {
+	_, err := database.FindOne[models.Role](tx.Db(), tx, bson.M{"slug": slug})
+	if err == nil || !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	for _, role := range models.DefaultRoles() {
+		if role.Slug == slug {
+			_, err = database.NewQuery(ctx).InsertOne(tx, &role)
+			return err
+		}
+	}
+
+	return fmt.Errorf("unknown default role %q", slug)
+}
+
+type acceptInviteRequest struct {
+	Token    string `json:"token"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// acceptInvite lets an invited user, such as the owner of a newly
+// provisioned brand, choose their password. They are logged in right away.
+func (s *AuthService) acceptInvite(ctx *fiber.Ctx) error {
+	// Limit requests
+	lock, err := s.limiter.Acquire(5 * time.Second)
+	if err != nil {
+		log.Printf("[AuthService.acceptInvite] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+	defer s.limiter.Release(lock)
+
+	// Parse body
+	var data acceptInviteRequest
+	if err := ctx.BodyParser(&data); err != nil || len(data.Token) == 0 || len(data.Password) == 0 {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	dbName := database.GetBrandDb(ctx).Name()
+	userID, err := session.ConsumeInvite(ctx.UserContext(), dbName, data.Token)
+	if err != nil {
+		if errors.Is(err, session.ErrInviteNotFound) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		log.Printf("[AuthService.acceptInvite] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	password, err := hash.Password(data.Password)
+	if err != nil {
+		log.Printf("[AuthService.acceptInvite] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Invites are only for users who have no password yet.
+	query := database.NewQuery(ctx).
+		Set("password", password).
+		Where("deletedAt", bson.M{"$exists": false}).
+		Where("password", bson.M{"$in": bson.A{"", nil}})
+	if len(data.Name) > 0 {
+		query.Set("name", data.Name)
+	}
+
+	user := models.User{}
+	user.ID = userID
+	if err := query.FindOneAndUpdate(context.TODO(), &user); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		log.Printf("[AuthService.acceptInvite] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	token, sess, err := session.Create(ctx.UserContext(), dbName, user.ID, s.sessionTTL)
+	if err != nil {
+		log.Printf("[AuthService.acceptInvite] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.JSON(
+		fiber.Map{
+			"token":     token,
+			"expiresAt": sess.ExpiresAt,
+		},
+	)
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/app/session"
+	"white-label-crm/database"
+)
+
+type tokenResponse struct {
+	AccessToken  string    `json:"accessToken"`
+	TokenType    string    `json:"tokenType"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" form:"refreshToken"`
+}
+
+// token exchanges credentials for a JWT access token and a refresh token.
+func (s *AuthService) token(ctx *fiber.Ctx) error {
+	// Limit requests
+	lock, err := s.limiter.Acquire(5 * time.Second)
+	if err != nil {
+		log.Printf("[AuthService.token] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+	defer s.limiter.Release(lock)
+
+	// Parse body
+	var data loginRequest
+	if err := ctx.BodyParser(&data); err != nil {
+		log.Printf("[AuthService.token] %v\n", err)
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	user, err := s.checkCredentials(ctx, data)
+	if err != nil {
+		log.Printf("[AuthService.token] %v\n", err)
+		return ctx.SendStatus(fiber.StatusForbidden)
+	}
+
+	refreshToken, err := session.CreateRefreshToken(
+		ctx.UserContext(),
+		database.GetBrandDb(ctx).Name(),
+		user.ID,
+		s.refreshTokenTTL,
+	)
+	if err != nil {
+		log.Printf("[AuthService.token] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return s.sendTokens(ctx, user.ID, refreshToken)
+}
+
+// refreshToken rotates the refresh token and issues a new access token.
+func (s *AuthService) refreshToken(ctx *fiber.Ctx) error {
+	var data refreshTokenRequest
+	if err := ctx.BodyParser(&data); err != nil || len(data.RefreshToken) == 0 {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	refreshToken, userID, err := session.RotateRefreshToken(
+		ctx.UserContext(),
+		database.GetBrandDb(ctx).Name(),
+		data.RefreshToken,
+		s.refreshTokenTTL,
+	)
+	if err != nil {
+		if errors.Is(err, session.ErrRefreshTokenReused) {
+			log.Printf("[AuthService.refreshToken] Reuse detected, family revoked\n")
+		} else if !errors.Is(err, session.ErrNotFound) {
+			log.Printf("[AuthService.refreshToken] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return ctx.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	return s.sendTokens(ctx, userID, refreshToken)
+}
+
+// revokeToken revokes the refresh token family, i.e. logs the client out.
+func (s *AuthService) revokeToken(ctx *fiber.Ctx) error {
+	var data refreshTokenRequest
+	if err := ctx.BodyParser(&data); err != nil || len(data.RefreshToken) == 0 {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := session.RevokeRefreshToken(ctx.UserContext(), database.GetBrandDb(ctx).Name(), data.RefreshToken)
+	if err != nil {
+		log.Printf("[AuthService.revokeToken] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *AuthService) sendTokens(ctx *fiber.Ctx, userID primitive.ObjectID, refreshToken string) error {
+	brand, ok := ctx.Locals("brand").(models.Brand)
+	if !ok {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	accessToken, expiresAt, err := session.IssueAccessToken(ctx.UserContext(), brand, userID, s.accessTokenTTL)
+	if err != nil {
+		if errors.Is(err, session.ErrNoSigningKey) {
+			return ctx.SendStatus(fiber.StatusNotImplemented)
+		}
+
+		log.Printf("[AuthService.sendTokens] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.JSON(
+		tokenResponse{
+			AccessToken:  accessToken,
+			TokenType:    "Bearer",
+			ExpiresAt:    expiresAt,
+			RefreshToken: refreshToken,
+		},
+	)
+}
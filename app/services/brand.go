@@ -0,0 +1,319 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"time"
+	"white-label-crm/app/bundle"
+	"white-label-crm/app/middleware/rbac"
+	"white-label-crm/app/models"
+	"white-label-crm/app/policy"
+	"white-label-crm/app/provisioning"
+	"white-label-crm/app/session"
+	"white-label-crm/database"
+	"white-label-crm/jwt"
+	"white-label-crm/redis"
+)
+
+// BrandService holds the brand endpoints of the admin API that the generic
+// resource doesn't cover. It runs against the system database.
+type BrandService struct {
+}
+
+func NewBrandService() *BrandService {
+	return &BrandService{}
+}
+
+func (b *BrandService) RegisterRoutes(router *fiber.App) {
+	api := router.Group("/brands")
+
+	api.Post("/:id/suspend", rbac.Require("brands.suspend"), b.suspend)
+	api.Post("/:id/unsuspend", rbac.Require("brands.suspend"), b.unsuspend)
+	api.Post("/:id/invite", rbac.Require("brands.invite"), b.inviteOwner)
+	api.Get("/:id/signing-keys", rbac.Require("brands.read"), b.signingKeys)
+	api.Post("/:id/signing-keys", rbac.Require("brands.rotateKeys"), b.rotateSigningKey)
+	api.Delete("/:id/signing-keys/:kid", rbac.Require("brands.rotateKeys"), b.revokeSigningKey)
+	api.Get("/:id/usage", rbac.Require("brands.read"), b.usage)
+	api.Get("/:id/export", rbac.Require("brands.export"), b.export)
+	api.Post("/:id/import", rbac.Require("brands.import"), b.importArchive)
+}
+
+// BrandResourceOptions hooks the generic brand endpoints of the admin API.
+func BrandResourceOptions() ResourceOptions[models.Brand] {
+	return ResourceOptions[models.Brand]{
+		BeforeCreate: func(ctx *fiber.Ctx, brand *models.Brand) error {
+			// The watcher provisions the brand as soon as it's inserted;
+			// pending also lets the retries pick it up should that fail.
+			brand.Provisioning = &models.BrandProvisioning{Status: models.ProvisioningPending}
+
+			if len(brand.Plan) == 0 {
+				brand.Plan = models.DefaultPlan
+			}
+
+			return nil
+		},
+	}
+}
+
+type suspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (b *BrandService) suspend(ctx *fiber.Ctx) error {
+	var data suspendRequest
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&data); err != nil {
+			return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+		}
+	}
+
+	query := database.NewQuery(ctx).
+		Set("suspendedAt", time.Now()).
+		Set("suspendedReason", data.Reason)
+
+	return b.update(ctx, query)
+}
+
+func (b *BrandService) unsuspend(ctx *fiber.Ctx) error {
+	return b.update(ctx, database.NewQuery(ctx).Unset("suspendedAt", "suspendedReason"))
+}
+
+// inviteOwner issues a new invite for the owner to choose their password,
+// revoking the previous one. The link is only ever in this response.
+func (b *BrandService) inviteOwner(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	url, expiresAt, err := provisioning.InviteOwner(context.TODO(), brand.ID)
+	switch {
+	case err == nil:
+		ctx.Set(fiber.HeaderCacheControl, "no-store")
+		return ctx.Status(fiber.StatusCreated).JSON(fiber.Map{"inviteUrl": url, "expiresAt": expiresAt})
+	case errors.Is(err, provisioning.ErrNoOwner), errors.Is(err, provisioning.ErrOwnerActive):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[BrandService.inviteOwner] %s | %v\n", brand.Slug, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// signingKeys lists the keys of the brand; only public keys are shown.
+func (b *BrandService) signingKeys(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	keys, err := session.SigningKeys(context.TODO(), brand.ID)
+	if err != nil {
+		log.Printf("[BrandService.signingKeys] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.JSON(policy.FilterAll(keys, false))
+}
+
+type rotateSigningKeyRequest struct {
+	Algorithm string `json:"algorithm"`
+}
+
+// rotateSigningKey makes a new key the one the brand's access tokens are
+// signed with. Tokens signed with the previous keys stay valid until they
+// expire.
+func (b *BrandService) rotateSigningKey(ctx *fiber.Ctx) error {
+	data := rotateSigningKeyRequest{Algorithm: string(session.DefaultSigningAlgorithm)}
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&data); err != nil {
+			return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+		}
+	}
+
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	key, err := session.RotateSigningKey(context.TODO(), brand.ID, jwt.Algorithm(data.Algorithm))
+	switch {
+	case err == nil:
+		return ctx.Status(fiber.StatusCreated).JSON(policy.For(key).Filter(key, false))
+	case errors.Is(err, session.ErrUnsupportedAlgorithm):
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "algorithm must be EdDSA or HS256"})
+	}
+
+	log.Printf("[BrandService.rotateSigningKey] %s | %v\n", brand.Slug, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// revokeSigningKey deletes a key, rejecting the tokens it signed right
+// away. It is meant for keys that leaked; rotate otherwise.
+func (b *BrandService) revokeSigningKey(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	err = session.RevokeSigningKey(context.TODO(), brand.ID, ctx.Params("kid"))
+	switch {
+	case err == nil:
+		return ctx.SendStatus(fiber.StatusNoContent)
+	case errors.Is(err, session.ErrUnknownKey):
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	log.Printf("[BrandService.revokeSigningKey] %s | %v\n", brand.Slug, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// find returns the live brand of the :id parameter.
+func (b *BrandService) find(ctx *fiber.Ctx) (*models.Brand, error) {
+	id, err := primitive.ObjectIDFromHex(ctx.Params("id"))
+	if err != nil {
+		return nil, err
+	}
+
+	return database.FindOne[models.Brand](database.GetBrandDb(ctx), context.TODO(), bson.M{"_id": id})
+}
+
+// usage returns the limits of the brand along with what it used, as last
+// persisted, month by month.
+func (b *BrandService) usage(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	usage, err := database.Find[models.BrandUsage](
+		database.GetBrandDb(ctx),
+		context.TODO(),
+		bson.M{"brand": brand.ID},
+		options.Find().SetSort(bson.D{{Key: "period", Value: -1}}).SetLimit(12),
+	)
+	if err != nil {
+		log.Printf("[BrandService.usage] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.JSON(
+		fiber.Map{
+			"plan":   brand.Plan,
+			"limits": brand.EffectiveLimits(),
+			"usage":  usage,
+		},
+	)
+}
+
+// export streams the brand database as an archive.
+func (b *BrandService) export(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		log.Printf("[BrandService.export] %s | %v\n", brand.Slug, err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	ctx.Set(fiber.HeaderContentType, "application/zip")
+	ctx.Attachment(bundle.FileName(brand.Slug, time.Now()))
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// The status is sent by now, a failure can only cut the archive
+		// short, which the missing manifest gives away.
+		if _, err := bundle.Export(context.Background(), db, brand.Slug, w); err != nil {
+			log.Printf("[BrandService.export] %s | %v\n", brand.Slug, err)
+		}
+
+		if err := w.Flush(); err != nil {
+			log.Printf("[BrandService.export] %s | %v\n", brand.Slug, err)
+		}
+	})
+
+	return nil
+}
+
+// importArchive restores the archive sent as the body into the brand:
+//
+//	POST /brands/:id/import?conflict=fail|skip|overwrite&remapIds=true&dryRun=true
+func (b *BrandService) importArchive(ctx *fiber.Ctx) error {
+	brand, err := b.find(ctx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	opts := bundle.ImportOptions{
+		Conflict: bundle.ConflictPolicy(ctx.Query("conflict", string(bundle.ConflictFail))),
+		RemapIDs: ctx.QueryBool("remapIds"),
+		DryRun:   ctx.QueryBool("dryRun"),
+	}
+
+	if !opts.Conflict.Valid() {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "conflict must be fail, skip or overwrite"})
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		log.Printf("[BrandService.importArchive] %s | %v\n", brand.Slug, err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	body := ctx.Body()
+	report, err := bundle.Import(context.TODO(), bytes.NewReader(body), int64(len(body)), db, opts)
+	switch {
+	case err == nil:
+		return ctx.JSON(report)
+	case errors.Is(err, bundle.ErrConflict):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error(), "report": report})
+	case errors.Is(err, bundle.ErrNotProvisioned), errors.Is(err, redis.ErrLocked):
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, bundle.ErrCorrupted), errors.Is(err, bundle.ErrUnsupported):
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[BrandService.importArchive] %s | %v\n", brand.Slug, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+func (b *BrandService) update(ctx *fiber.Ctx, query *database.Query) error {
+	id, err := primitive.ObjectIDFromHex(ctx.Params("id"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	brand := &models.Brand{}
+	brand.ID = id
+	query.Where("deletedAt", bson.M{"$exists": false})
+	if err := query.FindOneAndUpdate(context.TODO(), brand); err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("[BrandService.update] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// Either it doesn't exist, or the If-Match version is stale.
+		current, err := database.FindOne[models.Brand](database.GetBrandDb(ctx), context.TODO(), bson.M{"_id": id})
+		if err != nil {
+			return ctx.SendStatus(fiber.StatusNotFound)
+		}
+
+		setETag(ctx, current)
+		return ctx.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	setETag(ctx, brand)
+	return ctx.JSON(policy.For(brand).Filter(brand, policy.IsAdmin(ctx, brand)))
+}
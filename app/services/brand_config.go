@@ -0,0 +1,49 @@
+package services
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"white-label-crm/app/middleware/brand"
+)
+
+// BrandConfigService lets clients theme themselves for the brand they're
+// served on, before anyone logs in.
+type BrandConfigService struct {
+}
+
+func NewBrandConfigService() *BrandConfigService {
+	return &BrandConfigService{}
+}
+
+func (b *BrandConfigService) RegisterRoutes(router *fiber.App) {
+	router.Get("/brand/config", b.config)
+}
+
+func (b *BrandConfigService) config(ctx *fiber.Ctx) error {
+	current, ok := brand.Current(ctx)
+	if !ok {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	settings := current.EffectiveSettings()
+
+	// Brands change rarely, and the cache behind this is a few seconds
+	// stale anyway.
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=60")
+	ctx.Vary(fiber.HeaderHost, "X-Brand")
+
+	// The email sender is left out: it's only for the emails we send.
+	return ctx.JSON(
+		fiber.Map{
+			"name":            current.Name,
+			"slug":            current.Slug,
+			"canonicalDomain": current.CanonicalDomain,
+			"logoUrl":         settings.LogoURL,
+			"faviconUrl":      settings.FaviconURL,
+			"colors":          settings.Colors,
+			"locale":          settings.Locale,
+			"timezone":        settings.Timezone,
+			"currency":        settings.Currency,
+			"legal":           settings.Legal,
+		},
+	)
+}
@@ -2,29 +2,247 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"log"
-	"reflect"
-	"strings"
-	"white-label-crm/app/models"
+	"white-label-crm/app/listing"
+	"white-label-crm/app/middleware/rbac"
+	"white-label-crm/app/policy"
+	"white-label-crm/app/quota"
 	"white-label-crm/database"
 )
 
-type CrudService struct{}
+// CrudService is a registry of models that get generic REST endpoints.
+type CrudService struct {
+	resources []resource
+}
+
+type resource interface {
+	register(router fiber.Router)
+}
+
+// Validator is implemented by models that need to check their fields
+// before being written.
+type Validator interface {
+	Validate() error
+}
+
+type ResourceOptions[T any] struct {
+	// Permission prefix, defaults to the collection name.
+	Permission string
+	// BeforeWrite checks a create or update once the body is applied to
+	// the record; before is nil when creating. Errors are reported like
+	// field errors.
+	BeforeWrite func(ctx *fiber.Ctx, before *T, after *T) error
+	// BeforeDelete checks a delete before it is applied.
+	BeforeDelete func(ctx *fiber.Ctx, record *T, force bool) error
+	// BeforeCreate runs once the record is validated, right before it's
+	// inserted.
+	BeforeCreate func(ctx *fiber.Ctx, record *T) error
+	AfterCreate  func(ctx *fiber.Ctx, record *T) error
+	AfterDelete  func(ctx *fiber.Ctx, record *T, force bool) error
+}
+
+type Resource[T any, R resourceModel[T]] struct {
+	path       string
+	permission string
+	opts       ResourceOptions[T]
+}
+
+type resourceModel[T any] interface {
+	*T
+	database.CollectionModel
+	ETag() string
+}
 
 func NewCrudService() *CrudService {
 	return &CrudService{}
 }
 
 func (c *CrudService) RegisterRoutes(router *fiber.App) {
-	router.Get("/test", c.list)
-	router.Put("/test/:record", c.update)
+	for _, r := range c.resources {
+		r.register(router)
+	}
+}
+
+// RegisterResource exposes the model under path. Every route requires the
+// "<permission>.<action>" permission and honours the model's field policy.
+func RegisterResource[T any, R resourceModel[T]](c *CrudService, path string, opts ResourceOptions[T]) *Resource[T, R] {
+	r := &Resource[T, R]{
+		path:       path,
+		permission: opts.Permission,
+		opts:       opts,
+	}
+
+	if len(r.permission) == 0 {
+		var record T
+		r.permission = R(&record).GetCollectionName()
+	}
+
+	c.resources = append(c.resources, r)
+	return r
+}
+
+func (r *Resource[T, R]) register(router fiber.Router) {
+	api := router.Group(r.path)
+
+	api.Get("/", rbac.Require(r.permission+".read"), r.list)
+	api.Post("/", rbac.Require(r.permission+".create"), r.create)
+	api.Get("/:id", rbac.Require(r.permission+".read"), r.read)
+	api.Put("/:id", rbac.Require(r.permission+".update"), r.update)
+	api.Patch("/:id", rbac.Require(r.permission+".update"), r.patch)
+	api.Put("/:id/field", rbac.Require(r.permission+".update"), r.updateField)
+	api.Delete("/:id", rbac.Require(r.permission+".delete"), r.delete)
+	api.Post("/:id/restore", rbac.Require(r.permission+".restore"), r.restore)
+}
+
+func (r *Resource[T, R]) list(ctx *fiber.Ctx) error {
+	queryCtx := context.TODO()
+	switch ctx.Query("trashed") {
+	case "with":
+		queryCtx = database.WithTrashed(queryCtx)
+	case "only":
+		queryCtx = database.OnlyTrashed(queryCtx)
+	}
+
+	var model T
+	admin := policy.IsAdmin(ctx, R(&model))
+	params, err := listing.Parse(ctx, policy.For(R(&model)), admin)
+	if err != nil {
+		return sendListingError(ctx, err)
+	}
+
+	page, err := listing.List[T, R](database.GetBrandDb(ctx), queryCtx, bson.M{}, params)
+	if err != nil {
+		return sendListingError(ctx, err)
+	}
+
+	return ctx.JSON(
+		listing.Envelope{
+			Data:  policy.FilterAll(page.Data, admin),
+			Next:  page.Next,
+			Prev:  page.Prev,
+			Total: page.Total,
+		},
+	)
+}
+
+func (r *Resource[T, R]) read(ctx *fiber.Ctx) error {
+	record, err := r.find(ctx, context.TODO())
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	return r.send(ctx, fiber.StatusOK, record)
+}
+
+func (r *Resource[T, R]) create(ctx *fiber.Ctx) error {
+	var body map[string]interface{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	var value T
+	record := R(&value)
+	query := database.NewQuery(ctx)
+	if err := r.assign(ctx, query, record, body, true, false); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	if err := validate(record); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	if err := r.beforeWrite(ctx, nil, &value); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	resource := quota.ForCollection(record.GetCollectionName())
+	if err := quota.Check(ctx, resource); err != nil {
+		return quota.SendExceeded(ctx, err)
+	}
+
+	if r.opts.BeforeCreate != nil {
+		if err := r.opts.BeforeCreate(ctx, &value); err != nil {
+			log.Printf("[Resource.create] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	if _, err := query.InsertOne(context.TODO(), record); err != nil {
+		return sendWriteError(ctx, "Resource.create", err)
+	}
+
+	quota.Track(ctx, resource, 1)
+
+	if r.opts.AfterCreate != nil {
+		if err := r.opts.AfterCreate(ctx, &value); err != nil {
+			log.Printf("[Resource.create] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	return r.send(ctx, fiber.StatusCreated, record)
+}
+
+// update replaces every writable field; fields missing from the body are
+// reset to their zero value.
+func (r *Resource[T, R]) update(ctx *fiber.Ctx) error {
+	return r.write(ctx, true)
 }
 
-func (c *CrudService) list(ctx *fiber.Ctx) error {
-	return ctx.SendStatus(204)
+// patch only updates the fields present in the body.
+func (r *Resource[T, R]) patch(ctx *fiber.Ctx) error {
+	return r.write(ctx, false)
+}
+
+func (r *Resource[T, R]) write(ctx *fiber.Ctx, replace bool) error {
+	var body map[string]interface{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	record, err := r.find(ctx, context.TODO())
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	before := *(*T)(record)
+	query := database.NewQuery(ctx)
+	if err := r.assign(ctx, query, record, body, false, replace); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	if err := validate(record); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	if err := r.beforeWrite(ctx, &before, (*T)(record)); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if err := quota.Check(ctx, quota.Storage); err != nil {
+		return quota.SendExceeded(ctx, err)
+	}
+
+	result, err := query.UpdateOne(context.TODO(), record)
+	if err != nil {
+		return sendWriteError(ctx, "Resource.write", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return r.sendPreconditionFailed(ctx)
+	}
+
+	return r.send(ctx, fiber.StatusOK, record)
 }
 
 type updateRequest struct {
@@ -33,63 +251,375 @@ type updateRequest struct {
 	OldValue interface{} `json:"oldValue"`
 }
 
-func (c *CrudService) update(ctx *fiber.Ctx) error {
+// updateField is a compare-and-set of a single field: it only applies when
+// the field still holds oldValue.
+func (r *Resource[T, R]) updateField(ctx *fiber.Ctx) error {
 	// Parse body
 	var data updateRequest
 	if err := ctx.BodyParser(&data); err != nil {
-		log.Printf("[CrudService.update] %v\n", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+		log.Printf("[Resource.updateField] %v\n", err)
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
 	// Fetch record
-	id, err := primitive.ObjectIDFromHex(ctx.Params("record"))
+	record, err := r.find(ctx, context.TODO())
 	if err != nil {
 		return ctx.SendStatus(fiber.StatusNotFound)
 	}
 
-	user, err := database.FindOne[models.User](
+	// Check the field may be written to
+	admin := policy.IsAdmin(ctx, record)
+	field, err := policy.For(record).Writable(data.Field, admin, false)
+	if err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	value, err := field.Decode(data.NewValue)
+	if err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	before := *(*T)(record)
+	field.Assign(record, value)
+	if err := r.beforeWrite(ctx, &before, (*T)(record)); err != nil {
+		return sendFieldError(ctx, err)
+	}
+
+	// Compare-and-set: only update if the field still holds the value the
+	// caller last saw (and the record's version, when If-Match is sent).
+	query := database.NewQuery(ctx).Set(field.BSON, value)
+	if data.OldValue == nil {
+		query.Where(field.BSON, nil)
+	} else {
+		oldValue, err := field.Decode(data.OldValue)
+		if err != nil {
+			return sendFieldError(ctx, err)
+		}
+
+		query.Where(field.BSON, oldValue)
+	}
+
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	if err := quota.Check(ctx, quota.Storage); err != nil {
+		return quota.SendExceeded(ctx, err)
+	}
+
+	// Update field
+	result, err := query.UpdateOne(context.TODO(), record)
+	if err != nil {
+		return sendWriteError(ctx, "Resource.updateField", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return r.sendConflict(ctx, field, admin)
+	}
+
+	// Success
+	setETag(ctx, record)
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// delete soft deletes the record, or permanently deletes it with ?force=true.
+func (r *Resource[T, R]) delete(ctx *fiber.Ctx) error {
+	force := ctx.QueryBool("force")
+	if force && !rbac.Can(ctx, r.permission+".forceDelete") {
+		return ctx.SendStatus(fiber.StatusForbidden)
+	}
+
+	findCtx := context.TODO()
+	if force {
+		findCtx = database.WithTrashed(findCtx)
+	}
+
+	record, err := r.find(ctx, findCtx)
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	if r.opts.BeforeDelete != nil {
+		if err := r.opts.BeforeDelete(ctx, (*T)(record), force); err != nil {
+			return sendFieldError(ctx, err)
+		}
+	}
+
+	query := database.NewQuery(ctx)
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// Records in the trash don't count against the quota.
+	live := true
+	if model, ok := any(record).(interface{ IsDeleted() bool }); ok {
+		live = !model.IsDeleted()
+	}
+
+	var matched int64
+	if force {
+		result, err := query.HardDelete(context.TODO(), record)
+		if err != nil {
+			log.Printf("[Resource.delete] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		matched = result.DeletedCount
+	} else {
+		result, err := query.SoftDelete(context.TODO(), record)
+		if err != nil {
+			log.Printf("[Resource.delete] %v\n", err)
+			return ctx.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		matched = result.MatchedCount
+	}
+
+	if matched == 0 {
+		return r.sendPreconditionFailed(ctx)
+	}
+
+	if live {
+		quota.Track(ctx, quota.ForCollection(record.GetCollectionName()), -1)
+	}
+
+	if r.opts.AfterDelete != nil {
+		if err := r.opts.AfterDelete(ctx, (*T)(record), force); err != nil {
+			log.Printf("[Resource.delete] %v\n", err)
+		}
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func (r *Resource[T, R]) restore(ctx *fiber.Ctx) error {
+	record, err := r.find(ctx, database.OnlyTrashed(context.TODO()))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	query := database.NewQuery(ctx)
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	resource := quota.ForCollection(record.GetCollectionName())
+	if err := quota.Check(ctx, resource); err != nil {
+		return quota.SendExceeded(ctx, err)
+	}
+
+	result, err := query.Restore(context.TODO(), record)
+	if err != nil {
+		log.Printf("[Resource.restore] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if result.MatchedCount == 0 {
+		return r.sendPreconditionFailed(ctx)
+	}
+
+	quota.Track(ctx, resource, 1)
+
+	return r.send(ctx, fiber.StatusOK, record)
+}
+
+func (r *Resource[T, R]) find(ctx *fiber.Ctx, findCtx context.Context) (R, error) {
+	id, err := primitive.ObjectIDFromHex(ctx.Params("id"))
+	if err != nil {
+		return nil, err
+	}
+
+	return database.FindOne[T, R](
 		database.GetBrandDb(ctx),
-		context.TODO(),
+		findCtx,
 		bson.M{"_id": id},
 	)
+}
+
+func (r *Resource[T, R]) beforeWrite(ctx *fiber.Ctx, before *T, after *T) error {
+	if r.opts.BeforeWrite == nil {
+		return nil
+	}
+
+	return r.opts.BeforeWrite(ctx, before, after)
+}
+
+// assign decodes the body onto the record and the query. Every key must be
+// a field the caller may write to; when replacing, writable fields missing
+// from the body are reset.
+func (r *Resource[T, R]) assign(
+	ctx *fiber.Ctx,
+	query *database.Query,
+	record R,
+	body map[string]interface{},
+	creating bool,
+	replace bool,
+) error {
+	p := policy.For(record)
+	admin := policy.IsAdmin(ctx, record)
+
+	// Body keys may be any of a field's names, so track what was set by
+	// its BSON name.
+	set := make(map[string]bool, len(body))
+	for key, raw := range body {
+		field, err := p.Writable(key, admin, creating)
+		if err != nil {
+			return err
+		}
+
+		value, err := field.Decode(raw)
+		if err != nil {
+			return err
+		}
+
+		field.Assign(record, value)
+		query.Set(field.BSON, value)
+		set[field.BSON] = true
+	}
+
+	if !replace {
+		return nil
+	}
+
+	for _, field := range p.Fields() {
+		if set[field.BSON] || !field.CanWrite(admin, creating) {
+			continue
+		}
+
+		field.Assign(record, nil)
+		query.Unset(field.BSON)
+	}
+
+	return nil
+}
+
+func (r *Resource[T, R]) send(ctx *fiber.Ctx, status int, record R) error {
+	setETag(ctx, record)
+	return ctx.Status(status).JSON(policy.For(record).Filter(record, policy.IsAdmin(ctx, record)))
+}
+
+// sendConflict reports the current value of a field that a compare-and-set
+// update failed to match.
+func (r *Resource[T, R]) sendConflict(ctx *fiber.Ctx, field policy.Field, admin bool) error {
+	current, err := r.find(ctx, context.TODO())
 	if err != nil {
 		return ctx.SendStatus(fiber.StatusNotFound)
 	}
 
-	// Update field
-	field := getFieldBsonName(*user, data.Field)
-	_, err = database.NewQuery(ctx).
-		Set(field, data.NewValue).
-		UpdateOne(context.TODO(), user)
+	setETag(ctx, current)
+
+	// The whole record changed since the version the caller sent.
+	if len(ctx.Get(fiber.HeaderIfMatch)) > 0 && ctx.Get(fiber.HeaderIfMatch) != current.ETag() {
+		return ctx.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	return ctx.Status(fiber.StatusConflict).JSON(
+		fiber.Map{
+			"field":        field.JSON,
+			"currentValue": policy.For(current).Filter(current, admin)[field.JSON],
+		},
+	)
+}
+
+func (r *Resource[T, R]) sendPreconditionFailed(ctx *fiber.Ctx) error {
+	current, err := r.find(ctx, database.WithTrashed(context.TODO()))
 	if err != nil {
-		log.Printf("[CrudService.update] %v\n", err)
-		return ctx.SendStatus(fiber.StatusInternalServerError)
+		return ctx.SendStatus(fiber.StatusNotFound)
 	}
 
-	// Success
-	return ctx.SendStatus(204)
+	setETag(ctx, current)
+	return ctx.SendStatus(fiber.StatusPreconditionFailed)
+}
+
+type validationError struct {
+	err error
 }
 
-func getFieldBsonName(record interface{}, field string) string {
-	t := reflect.TypeOf(record)
-	if t.Kind() != reflect.Struct {
-		return field
+func (e *validationError) Error() string {
+	return e.err.Error()
+}
+
+func validate(record interface{}) error {
+	validator, ok := record.(Validator)
+	if !ok {
+		return nil
 	}
 
-	f, exists := t.FieldByName(field)
-	if !exists {
-		return field
+	if err := validator.Validate(); err != nil {
+		return &validationError{err: err}
 	}
 
-	tag, ok := f.Tag.Lookup("bson")
-	if !ok {
-		return field
+	return nil
+}
+
+func sendListingError(ctx *fiber.Ctx, err error) error {
+	var listingErr *listing.Error
+	if errors.As(err, &listingErr) {
+		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[sendListingError] %v\n", err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// sendWriteError responds to a failed insert or update. Unique indexes
+// reject duplicates, which is the client's doing.
+func sendWriteError(ctx *fiber.Ctx, method string, err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "a record with the same value already exists"})
+	}
+
+	log.Printf("[%s] %v\n", method, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
+
+// sendFieldError responds to the errors returned while writing fields of a
+// record: policy violations, undecodable values and failed validation.
+func sendFieldError(ctx *fiber.Ctx, err error) error {
+	var forbidden *policy.ForbiddenFieldError
+	if errors.As(err, &forbidden) {
+		return ctx.Status(fiber.StatusForbidden).JSON(
+			fiber.Map{
+				"error": err.Error(),
+				"field": forbidden.Field,
+			},
+		)
+	}
+
+	var unknown *policy.UnknownFieldError
+	if errors.As(err, &unknown) {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(
+			fiber.Map{
+				"error": err.Error(),
+				"field": unknown.Field,
+			},
+		)
+	}
+
+	var invalid *policy.InvalidValueError
+	if errors.As(err, &invalid) {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(
+			fiber.Map{
+				"error": err.Error(),
+				"field": invalid.Field,
+			},
+		)
+	}
+
+	var grant *grantError
+	if errors.As(err, &grant) {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if errors.Is(err, errUnknownRole) {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	parts := strings.Split(tag, ",")
-	if len(parts) < 1 || len(parts[0]) == 0 {
-		return field
+	var validation *validationError
+	if errors.As(err, &validation) {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	return parts[0]
+	log.Printf("[sendFieldError] %v\n", err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
 }
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"white-label-crm/database"
+)
+
+// ifMatch scopes the query to the version in the If-Match header, if one
+// was sent. The returned bool is false when the header is malformed.
+func ifMatch(ctx *fiber.Ctx, query *database.Query) bool {
+	header := ctx.Get(fiber.HeaderIfMatch)
+	if len(header) == 0 || header == "*" {
+		return true
+	}
+
+	version, err := database.ParseETag(header)
+	if err != nil {
+		return false
+	}
+
+	query.IfVersion(version)
+	return true
+}
+
+// setETag sends the record's current version.
+func setETag(ctx *fiber.Ctx, record interface{ ETag() string }) {
+	ctx.Set(fiber.HeaderETag, record.ETag())
+}
@@ -0,0 +1,31 @@
+package services
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"white-label-crm/app/features"
+)
+
+// FeatureService tells clients which features to show the current user.
+type FeatureService struct {
+}
+
+func NewFeatureService() *FeatureService {
+	return &FeatureService{}
+}
+
+func (f *FeatureService) RegisterRoutes(router *fiber.App) {
+	router.Get("/features", f.list)
+}
+
+func (f *FeatureService) list(ctx *fiber.Ctx) error {
+	keys, err := features.EnabledKeys(ctx)
+	if err != nil {
+		log.Printf("[FeatureService.list] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Evaluated per user, so it can't be shared.
+	ctx.Set(fiber.HeaderCacheControl, "private, no-cache")
+	return ctx.JSON(fiber.Map{"features": keys})
+}
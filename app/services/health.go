@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"time"
+	"white-label-crm/redis"
+)
+
+// HealthService reports the state of this instance, including which
+// instance leads the brand watcher.
+type HealthService struct {
+	watcher *redis.Election
+}
+
+func NewHealthService(watcher *redis.Election) *HealthService {
+	return &HealthService{watcher: watcher}
+}
+
+func (h *HealthService) RegisterRoutes(router *fiber.App) {
+	router.Get("/health", h.health)
+}
+
+func (h *HealthService) health(ctx *fiber.Ctx) error {
+	leader, err := h.watcher.Leader(context.TODO())
+	if err != nil {
+		log.Printf("[HealthService.health] %v\n", err)
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(
+			fiber.Map{
+				"status":   "unavailable",
+				"instance": h.watcher.ID(),
+			},
+		)
+	}
+
+	watcher := fiber.Map{
+		"leader":   leader,
+		"isLeader": false,
+	}
+
+	if leading, since := h.watcher.IsLeader(); leading {
+		watcher["isLeader"] = true
+		watcher["leaderSince"] = since.Format(time.RFC3339)
+	}
+
+	// Nobody watching means the brand cache is going stale.
+	code, status := fiber.StatusOK, "ok"
+	if len(leader) == 0 {
+		code, status = fiber.StatusServiceUnavailable, "degraded"
+	}
+
+	return ctx.Status(code).JSON(
+		fiber.Map{
+			"status":   status,
+			"instance": h.watcher.ID(),
+			"watcher":  watcher,
+		},
+	)
+}
@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"regexp"
+	"slices"
+	"white-label-crm/app/listing"
+	"white-label-crm/app/middleware/rbac"
+	"white-label-crm/app/models"
+	"white-label-crm/app/policy"
+	"white-label-crm/database"
+)
+
+var roleSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+type RoleService struct {
+}
+
+func NewRoleService() *RoleService {
+	return &RoleService{}
+}
+
+func (r *RoleService) RegisterRoutes(router *fiber.App) {
+	api := router.Group("/roles")
+
+	api.Get("/", rbac.Require("roles.read"), r.list)
+	api.Post("/", rbac.Require("roles.create"), r.create)
+	api.Get("/:role", rbac.Require("roles.read"), r.read)
+	api.Put("/:role", rbac.Require("roles.update"), r.update)
+	api.Delete("/:role", rbac.Require("roles.delete"), r.delete)
+}
+
+type roleRequest struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	// Description is a pointer so that updates can tell a missing
+	// description from an empty one.
+	Description *string  `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (r *RoleService) list(ctx *fiber.Ctx) error {
+	admin := policy.IsAdmin(ctx, &models.Role{})
+	params, err := listing.Parse(ctx, policy.For(&models.Role{}), admin)
+	if err != nil {
+		return sendListingError(ctx, err)
+	}
+
+	page, err := listing.List[models.Role](database.GetBrandDb(ctx), context.TODO(), bson.M{}, params)
+	if err != nil {
+		return sendListingError(ctx, err)
+	}
+
+	return ctx.JSON(
+		listing.Envelope{
+			Data:  policy.FilterAll(page.Data, admin),
+			Next:  page.Next,
+			Prev:  page.Prev,
+			Total: page.Total,
+		},
+	)
+}
+
+func (r *RoleService) create(ctx *fiber.Ctx) error {
+	// Parse body
+	var data roleRequest
+	if err := ctx.BodyParser(&data); err != nil {
+		log.Printf("[RoleService.create] %v\n", err)
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if len(data.Name) == 0 || !roleSlugPattern.MatchString(data.Slug) {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if err := checkGrant(ctx, data.Permissions); err != nil {
+		return sendGrantError(ctx, "RoleService.create", err)
+	}
+
+	// Slugs are referenced by users, so they must be unique.
+	_, err := r.find(ctx, data.Slug)
+	if err == nil {
+		return ctx.SendStatus(fiber.StatusConflict)
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Printf("[RoleService.create] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	role := &models.Role{
+		Name:        data.Name,
+		Slug:        data.Slug,
+		Permissions: data.Permissions,
+	}
+
+	if data.Description != nil {
+		role.Description = *data.Description
+	}
+
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	_, err = database.NewQuery(ctx).InsertOne(context.TODO(), role)
+	if mongo.IsDuplicateKeyError(err) {
+		return ctx.SendStatus(fiber.StatusConflict)
+	}
+
+	if err != nil {
+		log.Printf("[RoleService.create] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.Status(fiber.StatusCreated).JSON(policy.For(role).Filter(role, policy.IsAdmin(ctx, role)))
+}
+
+func (r *RoleService) read(ctx *fiber.Ctx) error {
+	role, err := r.find(ctx, ctx.Params("role"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	setETag(ctx, role)
+	return ctx.JSON(policy.For(role).Filter(role, policy.IsAdmin(ctx, role)))
+}
+
+func (r *RoleService) update(ctx *fiber.Ctx) error {
+	// Parse body
+	var data roleRequest
+	if err := ctx.BodyParser(&data); err != nil {
+		log.Printf("[RoleService.update] %v\n", err)
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	role, err := r.find(ctx, ctx.Params("role"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	// The slug is what users reference, so it can't change.
+	query := database.NewQuery(ctx)
+	if len(data.Name) > 0 {
+		query.Set("name", data.Name)
+		role.Name = data.Name
+	}
+
+	if data.Description != nil {
+		query.Set("description", *data.Description)
+		role.Description = *data.Description
+	}
+
+	// Permissions of system roles are managed by the application.
+	if data.Permissions != nil {
+		if role.System {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+
+		if err := checkGrant(ctx, data.Permissions); err != nil {
+			return sendGrantError(ctx, "RoleService.update", err)
+		}
+
+		query.Set("permissions", data.Permissions)
+		role.Permissions = data.Permissions
+	}
+
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	result, err := query.UpdateOne(context.TODO(), role)
+	if err != nil {
+		log.Printf("[RoleService.update] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if result.MatchedCount == 0 {
+		return ctx.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	setETag(ctx, role)
+	return ctx.JSON(policy.For(role).Filter(role, policy.IsAdmin(ctx, role)))
+}
+
+func (r *RoleService) delete(ctx *fiber.Ctx) error {
+	role, err := r.find(ctx, ctx.Params("role"))
+	if err != nil {
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	if role.System {
+		return ctx.SendStatus(fiber.StatusForbidden)
+	}
+
+	if _, err = database.NewQuery(ctx).HardDelete(context.TODO(), role); err != nil {
+		log.Printf("[RoleService.delete] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Detach the role from everyone who had it, including trashed users
+	// who could otherwise get it back along with a new role of that slug.
+	_, err = database.NewQuery(ctx).
+		Where("roles", role.Slug).
+		Pull("roles", role.Slug).
+		UpdateMany(database.WithTrashed(context.TODO()), &models.User{})
+	if err != nil {
+		log.Printf("[RoleService.delete] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+func (r *RoleService) find(ctx *fiber.Ctx, slug string) (*models.Role, error) {
+	return database.FindOne[models.Role](
+		database.GetBrandDb(ctx),
+		context.TODO(),
+		bson.M{"slug": slug},
+	)
+}
+
+// grantError is returned when the current user tries to hand out access
+// they don't have themselves.
+type grantError struct {
+	message string
+}
+
+func (e *grantError) Error() string {
+	return e.message
+}
+
+// errUnknownRole is returned when assigning a role that doesn't exist.
+var errUnknownRole = errors.New("roles must exist")
+
+// checkGrant makes sure the current user holds every permission they're
+// granting, so nobody can give more access than they have. Wildcards are
+// compared as a whole: "users.*" is only held through "users.*" or "*".
+func checkGrant(ctx *fiber.Ctx, permissions []string) error {
+	granted, err := rbac.Permissions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, permission := range permissions {
+		if !rbac.Matches(granted, permission) {
+			return &grantError{message: fmt.Sprintf("cannot grant %q without holding it", permission)}
+		}
+	}
+
+	return nil
+}
+
+// checkRoleAssignment checks that the current user may change a user's
+// roles from current to next. Added roles must exist and only carry
+// permissions the current user holds, and only owners can add or remove
+// the owner role.
+func checkRoleAssignment(ctx *fiber.Ctx, db *mongo.Database, current []string, next []string) error {
+	if slices.Contains(current, models.OwnerRole) != slices.Contains(next, models.OwnerRole) && !isOwner(ctx) {
+		return &grantError{message: "only owners can assign the owner role"}
+	}
+
+	var added []string
+	for _, slug := range next {
+		if !slices.Contains(current, slug) && !slices.Contains(added, slug) {
+			added = append(added, slug)
+		}
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	roles, err := database.Find[models.Role](db, context.TODO(), bson.M{"slug": bson.M{"$in": added}})
+	if err != nil {
+		return err
+	}
+
+	if len(roles) != len(added) {
+		return errUnknownRole
+	}
+
+	for _, role := range roles {
+		if err := checkGrant(ctx, role.Permissions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isOwner reports whether the current user has the owner role.
+func isOwner(ctx *fiber.Ctx) bool {
+	user, ok := ctx.Locals("currentUser").(*models.User)
+	return ok && slices.Contains(user.Roles, models.OwnerRole)
+}
+
+func sendGrantError(ctx *fiber.Ctx, handler string, err error) error {
+	var grant *grantError
+	if errors.As(err, &grant) {
+		return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if errors.Is(err, errUnknownRole) {
+		return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[%s] %v\n", handler, err)
+	return ctx.SendStatus(fiber.StatusInternalServerError)
+}
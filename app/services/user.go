@@ -5,10 +5,15 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"slices"
+	"white-label-crm/app/middleware/auth"
+	"white-label-crm/app/middleware/rbac"
 	"white-label-crm/app/models"
+	"white-label-crm/app/policy"
+	"white-label-crm/app/session"
 	"white-label-crm/database"
+	"white-label-crm/hash"
 )
 
 type UserService struct {
@@ -21,71 +26,171 @@ func NewUserService() *UserService {
 func (u *UserService) RegisterRoutes(router *fiber.App) {
 	api := router.Group("/users")
 
-	api.Get("/", u.list)
-	api.Post("/", u.create)
-	api.Get("/:user", u.read)
+	api.Put("/:user/roles", rbac.Require("roles.assign"), u.assignRoles)
+	api.Put("/:user/password", u.changePassword)
 }
 
-func (u *UserService) list(ctx *fiber.Ctx) error {
-	users, err := database.Find[models.User](
-		database.GetBrandDb(ctx),
-		context.TODO(),
-		bson.M{},
-		options.Find().SetLimit(10),
-	)
-	if err != nil {
-		log.Print(err)
-		return ctx.SendStatus(500)
+// UserResourceOptions hooks the generic user endpoints registered on the
+// CrudService.
+func UserResourceOptions() ResourceOptions[models.User] {
+	return ResourceOptions[models.User]{
+		BeforeWrite: func(ctx *fiber.Ctx, before *models.User, after *models.User) error {
+			var current []string
+			if before != nil {
+				if isProtectedOwner(ctx, before) {
+					return errOwnerProtected
+				}
+
+				current = before.Roles
+			}
+
+			return checkRoleAssignment(ctx, database.GetBrandDb(ctx), current, after.Roles)
+		},
+		BeforeDelete: func(ctx *fiber.Ctx, user *models.User, force bool) error {
+			if isProtectedOwner(ctx, user) {
+				return errOwnerProtected
+			}
+
+			return nil
+		},
+		AfterDelete: func(ctx *fiber.Ctx, user *models.User, force bool) error {
+			// A deleted user can no longer use their existing sessions.
+			return session.RevokeAll(context.TODO(), database.GetBrandDb(ctx).Name(), user.ID)
+		},
 	}
+}
 
-	return ctx.JSON(users)
+type assignRolesRequest struct {
+	Roles []string `json:"roles"`
 }
 
-func (u *UserService) create(ctx *fiber.Ctx) error {
-	user := &models.User{
-		Model: database.NewModel(ctx),
-		Name:  "John Doe",
-		Email: "john.doe@mail.com",
+func (u *UserService) assignRoles(ctx *fiber.Ctx) error {
+	// Parse body
+	var data assignRolesRequest
+	if err := ctx.BodyParser(&data); err != nil || data.Roles == nil {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
-	_, err := database.InsertOne[*models.User](database.GetBrandDb(ctx), context.TODO(), user)
+	id, err := primitive.ObjectIDFromHex(ctx.Params("user"))
 	if err != nil {
-		return ctx.SendStatus(500)
+		return ctx.SendStatus(404)
 	}
 
-	return ctx.JSON(user)
+	db := database.GetBrandDb(ctx)
+	user, err := database.FindOne[models.User](db, context.TODO(), bson.M{"_id": id})
+	if err != nil {
+		return ctx.SendStatus(404)
+	}
 
-	/*users := make([]*models.User, 5)
-	for i := range users {
-		users[i] = &models.User{
-			Name:  "John Doe",
-			Email: "john.doe@mail.com",
+	// A role listed twice is only assigned once.
+	slugs := make([]string, 0, len(data.Roles))
+	for _, slug := range data.Roles {
+		if !slices.Contains(slugs, slug) {
+			slugs = append(slugs, slug)
 		}
 	}
+	data.Roles = slugs
+
+	// Every new role must exist and the current user can't hand out more
+	// access than they have.
+	if err := checkRoleAssignment(ctx, db, user.Roles, data.Roles); err != nil {
+		return sendGrantError(ctx, "UserService.assignRoles", err)
+	}
 
-	err := database.InsertMany(context.TODO(), users)
+	query := database.NewQuery(ctx).Set("roles", data.Roles)
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
+	}
+
+	result, err := query.UpdateOne(context.TODO(), user)
 	if err != nil {
-		log.Printf("[UserService.create] %v\n", err)
+		log.Printf("[UserService.assignRoles] %v\n", err)
 		return ctx.SendStatus(500)
 	}
 
-	return ctx.JSON(users)*/
+	if result.MatchedCount == 0 {
+		return ctx.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	user.Roles = data.Roles
+	setETag(ctx, user)
+	return ctx.JSON(policy.For(user).Filter(user, policy.IsAdmin(ctx, user)))
+}
+
+type changePasswordRequest struct {
+	Password        string `json:"password"`
+	CurrentPassword string `json:"currentPassword"`
 }
 
-func (u *UserService) read(ctx *fiber.Ctx) error {
+// changePassword hashes and stores a new password. Users change their own
+// by confirming the current one; anyone else's requires "users.password".
+// Every session of the user is revoked afterwards.
+func (u *UserService) changePassword(ctx *fiber.Ctx) error {
+	// Parse body
+	var data changePasswordRequest
+	if err := ctx.BodyParser(&data); err != nil || len(data.Password) == 0 {
+		return ctx.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
 	id, err := primitive.ObjectIDFromHex(ctx.Params("user"))
 	if err != nil {
-		return ctx.SendStatus(404)
+		return ctx.SendStatus(fiber.StatusNotFound)
 	}
 
-	user, err := database.FindOne[models.User](
-		database.GetBrandDb(ctx),
-		context.TODO(),
-		bson.M{"_id": id},
-	)
+	currentUser := auth.CurrentUser(ctx)
+	if currentUser == nil {
+		return ctx.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	db := database.GetBrandDb(ctx)
+	user, err := database.FindOne[models.User](db, context.TODO(), bson.M{"_id": id})
 	if err != nil {
-		return ctx.SendStatus(404)
+		return ctx.SendStatus(fiber.StatusNotFound)
+	}
+
+	if user.ID == currentUser.ID {
+		if err := hash.Compare(data.CurrentPassword, user.Password); err != nil {
+			return ctx.SendStatus(fiber.StatusForbidden)
+		}
+	} else if !rbac.Can(ctx, "users.password") || isProtectedOwner(ctx, user) {
+		return ctx.SendStatus(fiber.StatusForbidden)
+	}
+
+	password, err := hash.Password(data.Password)
+	if err != nil {
+		log.Printf("[UserService.changePassword] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	query := database.NewQuery(ctx).Set("password", password)
+	if !ifMatch(ctx, query) {
+		return ctx.SendStatus(fiber.StatusBadRequest)
 	}
 
-	return ctx.JSON(user)
+	result, err := query.UpdateOne(context.TODO(), user)
+	if err != nil {
+		log.Printf("[UserService.changePassword] %v\n", err)
+		return ctx.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if result.MatchedCount == 0 {
+		return ctx.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	if err := session.RevokeAll(context.TODO(), db.Name(), user.ID); err != nil {
+		log.Printf("[UserService.changePassword] %v\n", err)
+	}
+
+	setETag(ctx, user)
+	return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// errOwnerProtected is returned by the user hooks when a non-owner changes
+// or deletes an owner.
+var errOwnerProtected = &grantError{message: "only owners can change or delete an owner"}
+
+// isProtectedOwner reports whether the user is an owner that the current
+// user, not being one, may not change or delete.
+func isProtectedOwner(ctx *fiber.Ctx, user *models.User) bool {
+	return slices.Contains(user.Roles, models.OwnerRole) && !isOwner(ctx)
 }
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"white-label-crm/redis"
+)
+
+var ErrInviteNotFound = errors.New("invite not found")
+
+// replaceInviteScript stores a new invite and deletes the user's previous
+// one, whose key the user's entry points to.
+var replaceInviteScript = redis2.NewScript(`
+local previous = redis.call("GET", KEYS[1])
+if previous then
+	redis.call("DEL", previous)
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+redis.call("SET", KEYS[1], KEYS[2], "PX", ARGV[2])
+return 1
+`)
+
+// CreateInvite issues a single use token letting the user set their
+// password. Like sessions, only its hash is stored. A user only has one
+// invite at a time: creating one revokes the previous.
+func CreateInvite(ctx context.Context, dbName string, userID primitive.ObjectID, ttl time.Duration) (string, error) {
+	raw := make([]byte, tokenLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err := replaceInviteScript.Run(
+		ctx,
+		redis.Client,
+		[]string{userInviteKey(dbName, userID), inviteKey(dbName, token)},
+		userID.Hex(),
+		ttl.Milliseconds(),
+	).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ConsumeInvite resolves the invite into its user and deletes it.
+func ConsumeInvite(ctx context.Context, dbName string, token string) (primitive.ObjectID, error) {
+	id, err := redis.Client.GetDel(ctx, inviteKey(dbName, token)).Result()
+	if err != nil {
+		if errors.Is(err, redis2.Nil) {
+			return primitive.NilObjectID, ErrInviteNotFound
+		}
+
+		return primitive.NilObjectID, err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, ErrInviteNotFound
+	}
+
+	return userID, nil
+}
+
+func inviteKey(dbName string, token string) string {
+	return fmt.Sprintf("invites:%s:%s", dbName, hashToken(token))
+}
+
+func userInviteKey(dbName string, userID primitive.ObjectID) string {
+	return fmt.Sprintf("invites:%s:$user:%s", dbName, userID.Hex())
+}
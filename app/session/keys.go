@@ -0,0 +1,321 @@
+package session
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/database"
+	"white-label-crm/jwt"
+)
+
+const (
+	keyCacheTTL = time.Minute
+	// An unknown key id reloads the keys at most this often, so tokens
+	// signed with a key rotated in on another instance are accepted
+	// without waiting for the cache to expire.
+	keyRefreshAfter = 5 * time.Second
+	// Rotated out keys still verify the access tokens they signed for
+	// this long, well past their expiry. RevokeSigningKey retires a key
+	// at once.
+	keyRetention = 24 * time.Hour
+	secretLength = 32
+)
+
+// DefaultSigningAlgorithm is used for the keys brands are given when they
+// first need one.
+const DefaultSigningAlgorithm = jwt.AlgorithmEdDSA
+
+var (
+	ErrNoSigningKey         = errors.New("brand has no signing key")
+	ErrUnknownKey           = errors.New("unknown signing key")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+)
+
+type cachedKeys struct {
+	keys      []*jwt.Key
+	active    *jwt.Key
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+var (
+	keyCache   = map[primitive.ObjectID]*cachedKeys{}
+	keyCacheMu sync.RWMutex
+)
+
+// SigningKey returns the brand's active key. A brand without one is given
+// a DefaultSigningAlgorithm key.
+func SigningKey(ctx context.Context, brandID primitive.ObjectID) (*jwt.Key, error) {
+	keys, err := loadKeys(ctx, brandID)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys.active == nil {
+		if _, err := EnsureSigningKey(ctx, brandID, DefaultSigningAlgorithm); err != nil {
+			return nil, err
+		}
+
+		if keys, err = loadKeys(ctx, brandID); err != nil {
+			return nil, err
+		}
+	}
+
+	if keys.active == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return keys.active, nil
+}
+
+// VerificationKey returns the brand's key with the given id, active or not.
+func VerificationKey(ctx context.Context, brandID primitive.ObjectID, kid string) (*jwt.Key, error) {
+	keys, err := loadKeys(ctx, brandID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys.keys {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+
+	if time.Since(keys.fetchedAt) < keyRefreshAfter {
+		return nil, ErrUnknownKey
+	}
+
+	forgetKeys(brandID)
+	return VerificationKey(ctx, brandID, kid)
+}
+
+// SigningKeys lists the keys of the brand, newest first.
+func SigningKeys(ctx context.Context, brandID primitive.ObjectID) ([]*models.SigningKey, error) {
+	return database.Find[models.SigningKey](
+		database.GetSystemDb(),
+		ctx,
+		bson.M{"brandId": brandID},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}),
+	)
+}
+
+// RotateSigningKey makes a new key the brand's active one. The previous
+// keys keep verifying tokens for keyRetention, older ones are deleted.
+func RotateSigningKey(ctx context.Context, brandID primitive.ObjectID, algorithm jwt.Algorithm) (*models.SigningKey, error) {
+	key, err := newSigningKey(brandID, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = withKeysTransaction(
+		ctx,
+		func(ctx mongo.SessionContext, keys *mongo.Collection) error {
+			// Deactivating first means there is never a second active key,
+			// and concurrent rotations conflict on the one they replace.
+			now := time.Now()
+			_, err := keys.UpdateMany(
+				ctx,
+				bson.M{"brandId": brandID, "active": true},
+				bson.M{
+					"$set": bson.M{"active": false, "updatedAt": now},
+					"$inc": bson.M{"version": 1},
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			if _, err := keys.InsertOne(ctx, key); err != nil {
+				return err
+			}
+
+			_, err = keys.DeleteMany(
+				ctx,
+				bson.M{"brandId": brandID, "active": false, "updatedAt": bson.M{"$lt": now.Add(-keyRetention)}},
+			)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	forgetKeys(brandID)
+	return key, nil
+}
+
+// EnsureSigningKey gives the brand a key unless it already has an active
+// one, returning the new key or nil.
+func EnsureSigningKey(ctx context.Context, brandID primitive.ObjectID, algorithm jwt.Algorithm) (*models.SigningKey, error) {
+	key, err := newSigningKey(brandID, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted := false
+	err = withKeysTransaction(
+		ctx,
+		func(ctx mongo.SessionContext, keys *mongo.Collection) error {
+			err := keys.FindOne(ctx, bson.M{"brandId": brandID, "active": true}).Err()
+			if err == nil {
+				return nil
+			}
+
+			if !errors.Is(err, mongo.ErrNoDocuments) {
+				return err
+			}
+
+			_, err = keys.InsertOne(ctx, key)
+			inserted = err == nil
+			return err
+		},
+	)
+	if err != nil || !inserted {
+		return nil, err
+	}
+
+	forgetKeys(brandID)
+	return key, nil
+}
+
+// RevokeSigningKey deletes the key so tokens signed with it are rejected
+// right away, by other instances once their cache expires. Revoking the
+// active key gives the brand a new one the next time it signs.
+func RevokeSigningKey(ctx context.Context, brandID primitive.ObjectID, kid string) error {
+	result, err := database.GetSystemDb().Collection((&models.SigningKey{}).GetCollectionName()).
+		DeleteOne(ctx, bson.M{"brandId": brandID, "kid": kid})
+	if err != nil {
+		return err
+	}
+
+	forgetKeys(brandID)
+	if result.DeletedCount == 0 {
+		return ErrUnknownKey
+	}
+
+	return nil
+}
+
+func withKeysTransaction(ctx context.Context, fn func(ctx mongo.SessionContext, keys *mongo.Collection) error) error {
+	db := database.GetSystemDb()
+	keys := db.Collection((&models.SigningKey{}).GetCollectionName())
+
+	return db.Client().UseSession(
+		ctx,
+		func(session mongo.SessionContext) error {
+			_, err := session.WithTransaction(
+				session,
+				func(ctx mongo.SessionContext) (interface{}, error) {
+					return nil, fn(ctx, keys)
+				},
+			)
+			return err
+		},
+	)
+}
+
+// newSigningKey generates the material of an active key: a random secret
+// for HS256, a key pair for EdDSA.
+func newSigningKey(brandID primitive.ObjectID, algorithm jwt.Algorithm) (*models.SigningKey, error) {
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	key := &models.SigningKey{
+		Model: database.Model{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: now,
+			UpdatedAt: now,
+			UpdatedBy: database.SystemUser,
+			Version:   1,
+		},
+		BrandID:   brandID,
+		KeyID:     hex.EncodeToString(kid),
+		Algorithm: string(algorithm),
+		Active:    true,
+	}
+
+	switch algorithm {
+	case jwt.AlgorithmHS256:
+		key.Secret = make([]byte, secretLength)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return nil, err
+		}
+	case jwt.AlgorithmEdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		key.PublicKey = public
+		key.PrivateKey = private
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	return key, nil
+}
+
+func loadKeys(ctx context.Context, brandID primitive.ObjectID) (*cachedKeys, error) {
+	keyCacheMu.RLock()
+	cached, ok := keyCache[brandID]
+	keyCacheMu.RUnlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached, nil
+	}
+
+	// Oldest first, so should two keys ever be active the newest wins.
+	records, err := database.Find[models.SigningKey](
+		database.GetSystemDb(),
+		ctx,
+		bson.M{"brandId": brandID},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cached = &cachedKeys{
+		keys:      make([]*jwt.Key, 0, len(records)),
+		fetchedAt: time.Now(),
+		expiresAt: time.Now().Add(keyCacheTTL),
+	}
+
+	for _, record := range records {
+		key := &jwt.Key{
+			ID:         record.KeyID,
+			Algorithm:  jwt.Algorithm(record.Algorithm),
+			Secret:     record.Secret,
+			PrivateKey: record.PrivateKey,
+			PublicKey:  record.PublicKey,
+		}
+
+		cached.keys = append(cached.keys, key)
+		if record.Active {
+			cached.active = key
+		}
+	}
+
+	keyCacheMu.Lock()
+	keyCache[brandID] = cached
+	keyCacheMu.Unlock()
+
+	return cached, nil
+}
+
+func forgetKeys(brandID primitive.ObjectID) {
+	keyCacheMu.Lock()
+	delete(keyCache, brandID)
+	keyCacheMu.Unlock()
+}
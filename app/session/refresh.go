@@ -0,0 +1,164 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"white-label-crm/redis"
+)
+
+var (
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// useScript marks a refresh token as used and returns its user, family and
+// use count, or nil when it doesn't exist. Doing both at once leaves no
+// window for two requests to see the token unused, and never recreates an
+// expired token without its TTL.
+var useScript = redis2.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+local uses = redis.call("HINCRBY", KEYS[1], "uses", 1)
+return {redis.call("HGET", KEYS[1], "user"), redis.call("HGET", KEYS[1], "family"), uses}
+`)
+
+// CreateRefreshToken starts a new token family for the user. Every
+// rotation keeps the family, so reuse of an already rotated token can
+// revoke every token descended from the same login.
+func CreateRefreshToken(ctx context.Context, dbName string, userID primitive.ObjectID, ttl time.Duration) (string, error) {
+	family := primitive.NewObjectID().Hex()
+	_, err := redis.Client.TxPipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			pipe.Set(ctx, familyKey(dbName, family), userID.Hex(), ttl)
+
+			// Track the user's families so RevokeAll can end them too.
+			userKey := userFamiliesKey(dbName, userID)
+			pipe.SAdd(ctx, userKey, family)
+			pipe.Expire(ctx, userKey, ttl)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return issueRefreshToken(ctx, dbName, userID, family, ttl)
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family. Presenting a token that was already rotated revokes the family
+// and returns ErrRefreshTokenReused.
+func RotateRefreshToken(ctx context.Context, dbName string, token string, ttl time.Duration) (string, primitive.ObjectID, error) {
+	// Mark as used; anything other than the first use is a replay.
+	result, err := useScript.Run(ctx, redis.Client, []string{refreshKey(dbName, token)}).Slice()
+	if err != nil {
+		if errors.Is(err, redis2.Nil) {
+			return "", primitive.NilObjectID, ErrNotFound
+		}
+
+		return "", primitive.NilObjectID, err
+	}
+
+	user, _ := result[0].(string)
+	family, _ := result[1].(string)
+	uses, _ := result[2].(int64)
+
+	userID, err := primitive.ObjectIDFromHex(user)
+	if err != nil {
+		return "", primitive.NilObjectID, ErrNotFound
+	}
+
+	if uses > 1 {
+		if err := redis.Client.Del(ctx, familyKey(dbName, family)).Err(); err != nil {
+			return "", primitive.NilObjectID, err
+		}
+
+		return "", primitive.NilObjectID, ErrRefreshTokenReused
+	}
+
+	// The family may have been revoked by an earlier replay.
+	renewed, err := redis.Client.Expire(ctx, familyKey(dbName, family), ttl).Result()
+	if err != nil {
+		return "", primitive.NilObjectID, err
+	}
+
+	if !renewed {
+		return "", primitive.NilObjectID, ErrNotFound
+	}
+
+	if err := redis.Client.Expire(ctx, userFamiliesKey(dbName, userID), ttl).Err(); err != nil {
+		return "", primitive.NilObjectID, err
+	}
+
+	newToken, err := issueRefreshToken(ctx, dbName, userID, family, ttl)
+	if err != nil {
+		return "", primitive.NilObjectID, err
+	}
+
+	return newToken, userID, nil
+}
+
+// RevokeRefreshToken revokes the family the token belongs to.
+func RevokeRefreshToken(ctx context.Context, dbName string, token string) error {
+	family, err := redis.Client.HGet(ctx, refreshKey(dbName, token), "family").Result()
+	if err != nil {
+		if errors.Is(err, redis2.Nil) {
+			return nil
+		}
+
+		return err
+	}
+
+	return redis.Client.Del(ctx, familyKey(dbName, family)).Err()
+}
+
+func issueRefreshToken(ctx context.Context, dbName string, userID primitive.ObjectID, family string, ttl time.Duration) (string, error) {
+	raw := make([]byte, tokenLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	key := refreshKey(dbName, token)
+
+	_, err := redis.Client.TxPipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			pipe.HSet(
+				ctx,
+				key,
+				"user", userID.Hex(),
+				"family", family,
+				"uses", 0,
+			)
+			pipe.Expire(ctx, key, ttl)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func refreshKey(dbName string, token string) string {
+	return fmt.Sprintf("refresh:%s:%s", dbName, hashToken(token))
+}
+
+func familyKey(dbName string, family string) string {
+	return fmt.Sprintf("refresh:%s:$family:%s", dbName, family)
+}
+
+func userFamiliesKey(dbName string, userID primitive.ObjectID) string {
+	return fmt.Sprintf("refresh:%s:$user:%s", dbName, userID.Hex())
+}
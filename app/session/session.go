@@ -0,0 +1,147 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"white-label-crm/redis"
+)
+
+const tokenLength = 32
+
+var (
+	ErrNotFound = errors.New("session not found")
+)
+
+type Session struct {
+	UserID    primitive.ObjectID
+	DbName    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Create issues a new opaque session token for the user. Only a hash of
+// the token is stored in Redis, scoped to the brand database so a token
+// issued for one brand cannot be used against another.
+func Create(ctx context.Context, dbName string, userID primitive.ObjectID, ttl time.Duration) (string, *Session, error) {
+	raw := make([]byte, tokenLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	session := &Session{
+		UserID:    userID,
+		DbName:    dbName,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	key := sessionKey(dbName, token)
+	_, err := redis.Client.TxPipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			pipe.HSet(
+				ctx,
+				key,
+				"user", userID.Hex(),
+				"createdAt", session.CreatedAt.Unix(),
+			)
+			pipe.Expire(ctx, key, ttl)
+
+			// Track the user's sessions so they can all be revoked at once.
+			userKey := userSessionsKey(dbName, userID)
+			pipe.SAdd(ctx, userKey, key)
+			pipe.Expire(ctx, userKey, ttl)
+
+			return nil
+		},
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// Get resolves a token into its session. ErrNotFound is returned when the
+// token was never issued, has expired or has been revoked.
+func Get(ctx context.Context, dbName string, token string) (*Session, error) {
+	key := sessionKey(dbName, token)
+
+	pipe := redis.Client.Pipeline()
+	data := pipe.HGetAll(ctx, key)
+	ttl := pipe.TTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(data.Val()) == 0 {
+		return nil, ErrNotFound
+	}
+
+	userID, err := primitive.ObjectIDFromHex(data.Val()["user"])
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var createdAt int64
+	if _, err := fmt.Sscanf(data.Val()["createdAt"], "%d", &createdAt); err != nil {
+		return nil, ErrNotFound
+	}
+
+	return &Session{
+		UserID:    userID,
+		DbName:    dbName,
+		CreatedAt: time.Unix(createdAt, 0),
+		ExpiresAt: time.Now().Add(ttl.Val()),
+	}, nil
+}
+
+// Revoke deletes a single session.
+func Revoke(ctx context.Context, dbName string, token string) error {
+	return redis.Client.Del(ctx, sessionKey(dbName, token)).Err()
+}
+
+// RevokeAll deletes every session and refresh token family belonging to
+// the user.
+func RevokeAll(ctx context.Context, dbName string, userID primitive.ObjectID) error {
+	userKey := userSessionsKey(dbName, userID)
+	keys, err := redis.Client.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	familiesKey := userFamiliesKey(dbName, userID)
+	families, err := redis.Client.SMembers(ctx, familiesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys, userKey, familiesKey)
+	for _, family := range families {
+		keys = append(keys, familyKey(dbName, family))
+	}
+
+	return redis.Client.Del(ctx, keys...).Err()
+}
+
+func sessionKey(dbName string, token string) string {
+	return fmt.Sprintf("sessions:%s:%s", dbName, hashToken(token))
+}
+
+func userSessionsKey(dbName string, userID primitive.ObjectID) string {
+	return fmt.Sprintf("sessions:%s:$user:%s", dbName, userID.Hex())
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"white-label-crm/app/models"
+	"white-label-crm/jwt"
+)
+
+// IssueAccessToken signs a short-lived JWT for the user, using the brand's
+// active key and its slug as the audience.
+func IssueAccessToken(ctx context.Context, brand models.Brand, userID primitive.ObjectID, ttl time.Duration) (string, time.Time, error) {
+	key, err := SigningKey(ctx, brand.ID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	token, err := jwt.Sign(
+		&jwt.Claims{
+			ID:        primitive.NewObjectID().Hex(),
+			Issuer:    brand.CanonicalDomain,
+			Subject:   userID.Hex(),
+			Audience:  brand.Slug,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+		key,
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// VerifyAccessToken validates a JWT against the brand's keys and returns
+// the id of the user it was issued to.
+func VerifyAccessToken(ctx context.Context, brand models.Brand, token string) (primitive.ObjectID, error) {
+	claims, err := jwt.Verify(
+		token,
+		brand.Slug,
+		func(header jwt.Header) (*jwt.Key, error) {
+			return VerificationKey(ctx, brand.ID, header.KeyID)
+		},
+	)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return primitive.NilObjectID, jwt.ErrMalformed
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/term"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"white-label-crm/app/bundle"
+	"white-label-crm/app/clusters"
+	"white-label-crm/app/models"
+	"white-label-crm/app/provisioning"
+	"white-label-crm/app/session"
+	"white-label-crm/database"
+	"white-label-crm/hash"
+	"white-label-crm/jwt"
+	"white-label-crm/migrations"
+	"white-label-crm/redis"
+)
+
+// runCommand runs a maintenance command instead of the http server,
+// returning the process exit code.
+func runCommand(args []string) int {
+	connectDatabase()
+	defer database.CloseConnection()
+
+	initRedis()
+	defer redis.CloseConnection()
+
+	var err error
+	switch args[0] {
+	case "migrate":
+		err = migrateCommand(args[1:])
+	case "indexes":
+		err = indexesCommand(args[1:])
+	case "provision":
+		err = provisionCommand(args[1:])
+	case "create-admin":
+		err = createAdminCommand(args[1:])
+	case "signing-keys":
+		err = signingKeysCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "import":
+		err = importCommand(args[1:])
+	case "move-brand":
+		err = moveBrandCommand(args[1:])
+	default:
+		log.Printf("Unknown command %q, expected one of: migrate, indexes, provision, create-admin, signing-keys, export, import, move-brand\n", args[0])
+		return 2
+	}
+
+	if err != nil {
+		log.Printf("[%s] %v\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+// migrateCommand:
+//
+//	migrate [up|down|status] [-brand slug,slug] [-system] [-dry-run] [-steps n]
+//
+// Without -brand or -system the system database and every brand are
+// migrated.
+func migrateCommand(args []string) error {
+	action := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	brands := flags.String("brand", "", "comma separated brand slugs to limit to")
+	systemOnly := flags.Bool("system", false, "only migrate the system database")
+	dryRun := flags.Bool("dry-run", false, "report what would run without running it")
+	steps := flags.Int("steps", 0, "number of migrations to roll back (default: last batch)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	opts := migrations.Options{DryRun: *dryRun, Steps: *steps}
+
+	targets, err := commandTargets(ctx, *brands, *systemOnly)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, t := range targets {
+		var err error
+		switch action {
+		case "up":
+			var result *migrations.Result
+			result, err = migrations.Migrate(ctx, t.db, t.scope, opts)
+			if result != nil {
+				printMigrated(result.Database, "Applied", result.Applied, *dryRun)
+			}
+		case "down":
+			var result *migrations.Result
+			result, err = migrations.Rollback(ctx, t.db, t.scope, opts)
+			if result != nil {
+				printMigrated(result.Database, "Rolled back", result.RolledBack, *dryRun)
+			}
+		case "status":
+			var entries []migrations.StatusEntry
+			entries, err = migrations.Status(ctx, t.db, t.scope)
+			for _, entry := range entries {
+				state := "pending"
+				if entry.Applied {
+					state = fmt.Sprintf("applied (batch %d, %s)", entry.Batch, entry.AppliedAt.Format("2006-01-02 15:04:05"))
+				}
+
+				fmt.Printf("%s\t%s\t%s\n", t.db.Name(), entry.ID, state)
+			}
+		default:
+			return fmt.Errorf("unknown action %q, expected up, down or status", action)
+		}
+
+		// Keep going so one broken brand doesn't block every other one.
+		if err != nil {
+			log.Printf("[migrate] %s | %v\n", t.db.Name(), err)
+			failed = append(failed, t.db.Name())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New("failed: " + strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func printMigrated(dbName string, verb string, ids []string, dryRun bool) {
+	if dryRun {
+		verb = "Would have " + strings.ToLower(verb[:1]) + verb[1:]
+	}
+
+	if len(ids) == 0 {
+		fmt.Fprintf(os.Stdout, "%s\tNothing to do\n", dbName)
+		return
+	}
+
+	for _, id := range ids {
+		fmt.Fprintf(os.Stdout, "%s\t%s %s\n", dbName, verb, id)
+	}
+}
+
+// indexesCommand:
+//
+//	indexes [-brand slug,slug] [-system] [-dry-run] [-rebuild] [-drop-unknown]
+//
+// Reports index drift and creates the missing indexes.
+func indexesCommand(args []string) error {
+	flags := flag.NewFlagSet("indexes", flag.ContinueOnError)
+	brands := flags.String("brand", "", "comma separated brand slugs to limit to")
+	systemOnly := flags.Bool("system", false, "only reconcile the system database")
+	dryRun := flags.Bool("dry-run", false, "only report drift")
+	rebuild := flags.Bool("rebuild", false, "drop and recreate indexes that differ from their declaration")
+	dropUnknown := flags.Bool("drop-unknown", false, "drop indexes no model declares")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	targets, err := commandTargets(ctx, *brands, *systemOnly)
+	if err != nil {
+		return err
+	}
+
+	opts := database.IndexOptions{DryRun: *dryRun, Rebuild: *rebuild, DropUnknown: *dropUnknown}
+
+	var failed []string
+	for _, t := range targets {
+		report, err := database.EnsureIndexes(ctx, t.db, indexedModels(t.scope), opts)
+		if report != nil {
+			printIndexReport(report)
+		}
+
+		if err != nil {
+			log.Printf("[indexes] %s | %v\n", t.db.Name(), err)
+			failed = append(failed, t.db.Name())
+		} else if len(report.Errors) > 0 {
+			failed = append(failed, t.db.Name())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New("failed: " + strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func printIndexReport(report *database.IndexReport) {
+	lines := []struct {
+		label string
+		names []string
+	}{
+		{"Missing", report.Missing},
+		{"Drifted", report.Drifted},
+		{"Unknown", report.Unknown},
+		{"Created", report.Created},
+		{"Dropped", report.Dropped},
+	}
+
+	if !report.HasDrift() {
+		fmt.Printf("%s\tUp to date\n", report.Database)
+	}
+
+	for _, line := range lines {
+		for _, name := range line.names {
+			fmt.Printf("%s\t%s %s\n", report.Database, line.label, name)
+		}
+	}
+
+	for _, err := range report.Errors {
+		fmt.Printf("%s\tError %v\n", report.Database, err)
+	}
+}
+
+// provisionCommand:
+//
+//	provision [-brand slug,slug] [-force] [-invite]
+//
+// Provisions the given brands, or every brand that is due. With -invite, a
+// new invite link is printed for owners who haven't chosen a password; it
+// isn't stored anywhere else.
+func provisionCommand(args []string) error {
+	flags := flag.NewFlagSet("provision", flag.ContinueOnError)
+	brands := flags.String("brand", "", "comma separated brand slugs to provision")
+	force := flags.Bool("force", false, "provision again even if already provisioned")
+	invite := flags.Bool("invite", false, "print a new invite link for the owner of each brand")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var ids []primitive.ObjectID
+	if len(*brands) > 0 {
+		found, err := database.Find[models.Brand](
+			database.GetSystemDb(),
+			ctx,
+			bson.M{"slug": bson.M{"$in": strings.Split(*brands, ",")}},
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, brand := range found {
+			ids = append(ids, brand.ID)
+		}
+	} else {
+		due, err := provisioning.Due(ctx)
+		if err != nil {
+			return err
+		}
+
+		ids = due
+	}
+
+	var failed []string
+	for _, id := range ids {
+		if err := provisioning.Provision(ctx, id, *force); err != nil {
+			log.Printf("[provision] %s | %v\n", id.Hex(), err)
+			failed = append(failed, id.Hex())
+			continue
+		}
+
+		fmt.Printf("%s\tProvisioned\n", id.Hex())
+
+		if *invite {
+			url, expiresAt, err := provisioning.InviteOwner(ctx, id)
+			if err != nil {
+				log.Printf("[provision] %s | %v\n", id.Hex(), err)
+				continue
+			}
+
+			fmt.Printf("%s\tInvite\t%s\t(expires %s)\n", id.Hex(), url, expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New("failed: " + strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// createAdminCommand:
+//
+//	create-admin -email admin@example.com [-name Name]
+//
+// Creates an administrator of the admin API. The password is prompted for,
+// or read from stdin when piped, so it doesn't end up in the shell history.
+func createAdminCommand(args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := flags.String("email", "", "email address to log in with")
+	name := flags.String("name", "", "display name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !strings.Contains(*email, "@") {
+		return errors.New("-email must be a valid email address")
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if len(password) == 0 {
+		return errors.New("password is required")
+	}
+
+	encoded, err := hash.Password(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user := models.User{
+		Model: database.Model{
+			ID:        primitive.NewObjectID(),
+			CreatedAt: now,
+			UpdatedAt: now,
+			UpdatedBy: database.SystemUser,
+			Version:   1,
+		},
+		Name:     *name,
+		Email:    *email,
+		Password: encoded,
+		Roles:    []string{models.SuperAdminRole().Slug},
+	}
+
+	ctx := context.Background()
+	if _, err := database.GetSystemDb().Collection(user.GetCollectionName()).InsertOne(ctx, user); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s\n", user.ID.Hex())
+	return nil
+}
+
+// readPassword prompts for a password without echoing it when stdin is a
+// terminal, and reads the first line of stdin otherwise.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Print("Password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+
+		return string(password), err
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// signingKeysCommand:
+//
+//	signing-keys [list|rotate|revoke] -brand slug [-algorithm EdDSA|HS256] [-kid id]
+//
+// Lists the brand's signing keys, makes a new key the one its access
+// tokens are signed with, or revokes a key so the tokens it signed are
+// rejected right away.
+func signingKeysCommand(args []string) error {
+	action := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("signing-keys", flag.ContinueOnError)
+	slug := flags.String("brand", "", "slug of the brand")
+	algorithm := flags.String("algorithm", string(session.DefaultSigningAlgorithm), "EdDSA or HS256, for rotate")
+	kid := flags.String("kid", "", "id of the key to revoke")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	brand, err := commandBrand(ctx, *slug)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		keys, err := session.SigningKeys(ctx, brand.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			state := "inactive"
+			if key.Active {
+				state = "active"
+			}
+
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.KeyID, key.Algorithm, state, key.CreatedAt.Format(time.RFC3339))
+		}
+	case "rotate":
+		key, err := session.RotateSigningKey(ctx, brand.ID, jwt.Algorithm(*algorithm))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\tActive\n", key.KeyID, key.Algorithm)
+	case "revoke":
+		if len(*kid) == 0 {
+			return errors.New("-kid is required")
+		}
+
+		if err := session.RevokeSigningKey(ctx, brand.ID, *kid); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\tRevoked\n", *kid)
+	default:
+		return fmt.Errorf("unknown action %q, expected list, rotate or revoke", action)
+	}
+
+	return nil
+}
+
+// exportCommand:
+//
+//	export -brand slug [-out file]
+//
+// Writes the whole brand database to an archive, named after the brand and
+// the time by default.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	slug := flags.String("brand", "", "slug of the brand to export")
+	out := flags.String("out", "", "archive to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	brand, err := commandBrand(ctx, *slug)
+	if err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		*out = bundle.FileName(brand.Slug, time.Now())
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	manifest, err := bundle.Export(ctx, db, brand.Slug, file)
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range manifest.Collections {
+		fmt.Printf("%s\t%d documents\n", collection.Name, collection.Documents)
+	}
+
+	fmt.Printf("Exported to %s\n", *out)
+	return file.Close()
+}
+
+// importCommand:
+//
+//	import -brand slug -in file [-conflict fail|skip|overwrite] [-remap-ids] [-dry-run]
+//
+// Restores an archive made by export into a brand, which must have been
+// created, and provisioned, beforehand.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	slug := flags.String("brand", "", "slug of the brand to import into")
+	in := flags.String("in", "", "archive to import")
+	conflict := flags.String("conflict", string(bundle.ConflictFail), "what to do with records that already exist: fail, skip or overwrite")
+	remapIDs := flags.Bool("remap-ids", false, "give the imported records new ids")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without importing it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	brand, err := commandBrand(ctx, *slug)
+	if err != nil {
+		return err
+	}
+
+	db, err := brand.Db()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	opts := bundle.ImportOptions{
+		Conflict: bundle.ConflictPolicy(*conflict),
+		RemapIDs: *remapIDs,
+		DryRun:   *dryRun,
+	}
+
+	report, err := bundle.Import(ctx, file, info.Size(), db, opts)
+	if report != nil {
+		for _, collection := range report.Collections {
+			fmt.Printf(
+				"%s\t%d inserted, %d replaced, %d skipped\n",
+				collection.Name,
+				collection.Inserted,
+				collection.Replaced,
+				collection.Skipped,
+			)
+
+			for _, id := range collection.Conflicts {
+				fmt.Printf("%s\tConflict %s\n", collection.Name, id)
+			}
+		}
+
+		for _, id := range report.Replayed {
+			fmt.Printf("Replayed %s\n", id)
+		}
+	}
+
+	return err
+}
+
+// moveBrandCommand:
+//
+//	move-brand -brand slug [-shared] [-drop-source]
+//
+// Moves the brand database to the cluster whose URI is read from stdin, as
+// it holds credentials, or back to the shared cluster with -shared. The
+// URI is stored encrypted with the key in BRAND_DATABASE_KEY.
+func moveBrandCommand(args []string) error {
+	flags := flag.NewFlagSet("move-brand", flag.ContinueOnError)
+	slug := flags.String("brand", "", "slug of the brand to move")
+	shared := flags.Bool("shared", false, "move the brand back to the shared cluster")
+	dropSource := flags.Bool("drop-source", false, "drop the brand database from the cluster it leaves")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	brand, err := commandBrand(ctx, *slug)
+	if err != nil {
+		return err
+	}
+
+	uri := ""
+	if !*shared {
+		fmt.Print("MongoDB URI: ")
+		uri, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		uri = strings.TrimSpace(uri)
+		if len(uri) == 0 {
+			return errors.New("a URI is required, or -shared")
+		}
+	}
+
+	return clusters.Move(ctx, brand.ID, uri, clusters.MoveOptions{DropSource: *dropSource})
+}
+
+// commandBrand finds the live brand with the slug.
+func commandBrand(ctx context.Context, slug string) (*models.Brand, error) {
+	if len(slug) == 0 {
+		return nil, errors.New("-brand is required")
+	}
+
+	brand, err := database.FindOne[models.Brand](database.GetSystemDb(), ctx, bson.M{"slug": slug})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("brand %q doesn't exist", slug)
+	}
+
+	return brand, err
+}
+
+type commandTarget struct {
+	db    *mongo.Database
+	scope migrations.Scope
+}
+
+// commandTargets resolves the -brand and -system flags shared by the
+// commands. By default that's the system database and every brand.
+func commandTargets(ctx context.Context, brands string, systemOnly bool) ([]commandTarget, error) {
+	var targets []commandTarget
+	if len(brands) == 0 {
+		targets = append(targets, commandTarget{db: database.GetSystemDb(), scope: migrations.ScopeSystem})
+	}
+
+	if systemOnly {
+		return targets, nil
+	}
+
+	var slugs []string
+	if len(brands) > 0 {
+		slugs = strings.Split(brands, ",")
+	}
+
+	dbs, err := migrations.BrandDatabases(ctx, slugs...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, db := range dbs {
+		targets = append(targets, commandTarget{db: db, scope: migrations.ScopeBrand})
+	}
+
+	return targets, nil
+}
+
+func indexedModels(scope migrations.Scope) []database.IndexedModel {
+	if scope == migrations.ScopeSystem {
+		return models.SystemModels()
+	}
+
+	return models.BrandModels()
+}
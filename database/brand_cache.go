@@ -0,0 +1,319 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"strings"
+	"white-label-crm/redis"
+)
+
+// The brand cache is laid out as:
+//
+//	brands:$id:<id>               hash of the cached brand fields
+//	brands:$host:<host>           id of the brand served on the host
+//	brands:$wildcard:<suffix>     id of the brand serving *.<suffix>
+//	brands:$slug:<slug>           id of the brand with the slug
+//	brands:$missing:<host>        the host is known not to have a brand
+//	brands:$missing-slug:<slug>   no brand has the slug
+//
+// A wildcard only covers one level of subdomains, like in certificates.
+
+func brandIDKey(id string) string {
+	return fmt.Sprintf("brands:$id:%s", id)
+}
+
+func brandHostKey(host string) string {
+	return fmt.Sprintf("brands:$host:%s", host)
+}
+
+func brandWildcardKey(suffix string) string {
+	return fmt.Sprintf("brands:$wildcard:%s", suffix)
+}
+
+func brandSlugKey(slug string) string {
+	return fmt.Sprintf("brands:$slug:%s", slug)
+}
+
+// MissingBrandKey marks a host known not to belong to any brand.
+func MissingBrandKey(host string) string {
+	return fmt.Sprintf("brands:$missing:%s", host)
+}
+
+// MissingBrandSlugKey marks a slug known not to belong to any brand.
+func MissingBrandSlugKey(slug string) string {
+	return fmt.Sprintf("brands:$missing-slug:%s", slug)
+}
+
+// domainKey is the key pointing the domain, which may be a wildcard, at
+// its brand.
+func domainKey(domain string) string {
+	if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+		return brandWildcardKey(suffix)
+	}
+
+	return brandHostKey(domain)
+}
+
+// WildcardFor returns the wildcard domain that would cover the host, or ""
+// for hosts without a parent domain.
+func WildcardFor(host string) string {
+	_, parent, ok := strings.Cut(host, ".")
+	if !ok || !strings.Contains(parent, ".") {
+		return ""
+	}
+
+	return "*." + parent
+}
+
+// FindCachedBrand returns the cached fields of the brand served on the
+// host, preferring an exact domain over a wildcard. missing is set when the
+// host is known not to have a brand; both are empty when nothing is cached.
+func FindCachedBrand(ctx context.Context, host string) (fields map[string]string, missing bool, err error) {
+	keys := []string{brandHostKey(host), MissingBrandKey(host)}
+	if wildcard := WildcardFor(host); len(wildcard) > 0 {
+		keys = append(keys, domainKey(wildcard))
+	}
+
+	values, err := redis.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	id, _ := values[0].(string)
+	if len(id) == 0 && len(values) > 2 {
+		id, _ = values[2].(string)
+	}
+
+	if len(id) == 0 {
+		return nil, values[1] != nil, nil
+	}
+
+	return findCachedBrandByID(ctx, id)
+}
+
+// FindCachedBrandBySlug is FindCachedBrand for a brand slug.
+func FindCachedBrandBySlug(ctx context.Context, slug string) (fields map[string]string, missing bool, err error) {
+	values, err := redis.Client.MGet(ctx, brandSlugKey(slug), MissingBrandSlugKey(slug)).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	id, _ := values[0].(string)
+	if len(id) == 0 {
+		return nil, values[1] != nil, nil
+	}
+
+	return findCachedBrandByID(ctx, id)
+}
+
+func findCachedBrandByID(ctx context.Context, id string) (map[string]string, bool, error) {
+	fields, err := redis.Client.HGetAll(ctx, brandIDKey(id)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, false, err
+	}
+
+	return fields, false, nil
+}
+
+// CacheBrand writes the brand document to the cache, replacing what was
+// cached for it before.
+func CacheBrand(ctx context.Context, doc map[string]interface{}) error {
+	brand := CachedBrandFields(doc)
+	domains := splitDomains(brand["domains"])
+
+	previous, err := redis.Client.HMGet(ctx, brandIDKey(brand["_id"]), "domains", "slug").Result()
+	if err != nil {
+		return err
+	}
+
+	previousDomains, _ := previous[0].(string)
+	previousSlug, _ := previous[1].(string)
+
+	_, err = redis.Client.TxPipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			for _, domain := range splitDomains(previousDomains) {
+				pipe.Del(ctx, domainKey(domain))
+			}
+
+			if len(previousSlug) > 0 {
+				pipe.Del(ctx, brandSlugKey(previousSlug))
+			}
+
+			key := brandIDKey(brand["_id"])
+			pipe.Del(ctx, key)
+			for k, v := range brand {
+				pipe.HSet(ctx, key, k, v)
+			}
+
+			pipe.Set(ctx, brandSlugKey(brand["slug"]), brand["_id"], 0)
+			pipe.Del(ctx, MissingBrandSlugKey(brand["slug"]))
+
+			for _, domain := range domains {
+				pipe.Set(ctx, domainKey(domain), brand["_id"], 0)
+
+				// The host may have been looked up before the brand had it.
+				if !strings.HasPrefix(domain, "*.") {
+					pipe.Del(ctx, MissingBrandKey(domain))
+				}
+			}
+
+			return nil
+		},
+	)
+
+	return err
+}
+
+// UncacheBrand removes the brand, its slug and its domains from the cache.
+func UncacheBrand(ctx context.Context, id primitive.ObjectID) error {
+	cached, err := redis.Client.HMGet(ctx, brandIDKey(id.Hex()), "domains", "slug").Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{brandIDKey(id.Hex())}
+	if slug, _ := cached[1].(string); len(slug) > 0 {
+		keys = append(keys, brandSlugKey(slug))
+	}
+
+	domains, _ := cached[0].(string)
+	for _, domain := range splitDomains(domains) {
+		keys = append(keys, domainKey(domain))
+	}
+
+	return redis.Client.Del(ctx, keys...).Err()
+}
+
+func splitDomains(domains string) []string {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	return strings.Split(domains, ",")
+}
+
+// CachedBrandFields picks the fields of a brand document that are cached.
+func CachedBrandFields(doc map[string]interface{}) map[string]string {
+	// Moving brands can't be used either.
+	suspended := "0"
+	_, suspendedAt := doc["suspendedAt"]
+	_, movingAt := doc["movingAt"]
+	if suspendedAt || movingAt {
+		suspended = "1"
+	}
+
+	// Still encrypted, only base64 encoded.
+	databaseURI := ""
+	if uri, ok := doc["databaseUri"].(primitive.Binary); ok {
+		databaseURI = base64.StdEncoding.EncodeToString(uri.Data)
+	}
+
+	str := func(key string) string {
+		value, _ := doc[key].(string)
+		return value
+	}
+
+	var domains []string
+	if values, ok := doc["domains"].(bson.A); ok {
+		for _, value := range values {
+			if domain, ok := value.(string); ok {
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	// Documents are kept whole, as relaxed extended JSON.
+	extJSON := func(key string) string {
+		value, ok := doc[key]
+		if !ok || value == nil {
+			return ""
+		}
+
+		encoded, err := bson.MarshalExtJSON(value, false, false)
+		if err != nil {
+			log.Printf("[database.CachedBrandFields] %s | %v\n", key, err)
+			return ""
+		}
+
+		return string(encoded)
+	}
+
+	return map[string]string{
+		"_id":             doc["_id"].(primitive.ObjectID).Hex(),
+		"name":            str("name"),
+		"slug":            str("slug"),
+		"canonicalDomain": str("canonicalDomain"),
+		"domains":         strings.Join(domains, ","),
+		"suspended":       suspended,
+		"settings":        extJSON("settings"),
+		"plan":            str("plan"),
+		"limits":          extJSON("limits"),
+		"databaseUri":     databaseURI,
+		"cluster":         str("cluster"),
+	}
+}
+
+// ReconcileBrandCache rebuilds the brand cache from `system.brands`,
+// dropping the entries of brands that were deleted or changed domains.
+func ReconcileBrandCache(ctx context.Context) error {
+	cursor, err := GetSystemDb().Collection("brands").Find(
+		ctx,
+		bson.M{"deletedAt": bson.M{"$exists": false}},
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	live := map[string]bool{}
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		if err := CacheBrand(ctx, doc); err != nil {
+			return err
+		}
+
+		fields := CachedBrandFields(doc)
+		live[brandIDKey(fields["_id"])] = true
+		live[brandSlugKey(fields["slug"])] = true
+		for _, domain := range splitDomains(fields["domains"]) {
+			live[domainKey(domain)] = true
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	var stale []string
+	keys := redis.Client.Scan(ctx, 0, "brands:*", 1000).Iterator()
+	for keys.Next(ctx) {
+		key := keys.Val()
+		// Both kinds of missing keys expire on their own.
+		if live[key] || strings.HasPrefix(key, "brands:$missing") {
+			continue
+		}
+
+		stale = append(stale, key)
+	}
+
+	if err := keys.Err(); err != nil {
+		return err
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	log.Printf("[database.ReconcileBrandCache] Removing %d stale keys\n", len(stale))
+	return redis.Client.Del(ctx, stale...).Err()
+}
@@ -0,0 +1,45 @@
+package database
+
+import "testing"
+
+func TestWildcardFor(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "acme.example.com", want: "*.example.com"},
+		{host: "a.b.example.com", want: "*.b.example.com"},
+		{host: "example.com", want: ""},
+		{host: "localhost", want: ""},
+		{host: "", want: ""},
+		{host: ".example.com", want: "*.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := WildcardFor(tt.host); got != tt.want {
+				t.Errorf("WildcardFor(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainKey(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{domain: "acme.example.com", want: "brands:$host:acme.example.com"},
+		{domain: "*.example.com", want: "brands:$wildcard:example.com"},
+		// Only a leading wildcard label is special.
+		{domain: "a.*.example.com", want: "brands:$host:a.*.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if got := domainKey(tt.domain); got != tt.want {
+				t.Errorf("domainKey(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
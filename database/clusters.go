@@ -0,0 +1,246 @@
+package database
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clusterKeyEnv holds the base64 encoded AES-256 key the URIs of the
+	// dedicated clusters are encrypted with.
+	clusterKeyEnv = "BRAND_DATABASE_KEY"
+	// Clients of dedicated clusters unused for that long are disconnected.
+	clusterIdleTimeout = 15 * time.Minute
+	evictionInterval   = time.Minute
+)
+
+var (
+	ErrNoClusterKey = errors.New(clusterKeyEnv + " must be a base64 encoded 32 byte key")
+	ErrCorruptedURI = errors.New("encrypted database URI is corrupted")
+)
+
+// Cluster is a dedicated MongoDB deployment holding the databases of some
+// brands, instead of the shared one. Brands on the same URI share it.
+type Cluster struct {
+	// ID is a fingerprint of the URI, see ClusterID.
+	ID string
+	// URI is encrypted with EncryptURI.
+	URI []byte
+}
+
+type pooledClient struct {
+	client *mongo.Client
+	// Connections checked out, so a client isn't evicted mid-operation.
+	inUse atomic.Int64
+	// lastUsed is in unix nanoseconds.
+	lastUsed atomic.Int64
+}
+
+func (p *pooledClient) touch() {
+	p.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (p *pooledClient) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.GetSucceeded:
+				p.inUse.Add(1)
+				p.touch()
+			case event.ConnectionReturned:
+				p.inUse.Add(-1)
+				p.touch()
+			}
+		},
+	}
+}
+
+var (
+	clusters   = map[string]*pooledClient{}
+	clustersMu sync.Mutex
+)
+
+// GetClusterDb returns the database on the cluster, connecting to it on
+// first use. A nil cluster is the shared one.
+func GetClusterDb(cluster *Cluster, name string) (*mongo.Database, error) {
+	if cluster == nil {
+		return client.Database(name), nil
+	}
+
+	c, err := clusterClient(*cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Database(name), nil
+}
+
+func clusterClient(cluster Cluster) (*mongo.Client, error) {
+	clustersMu.Lock()
+	defer clustersMu.Unlock()
+
+	if pooled, ok := clusters[cluster.ID]; ok {
+		pooled.touch()
+		return pooled.client, nil
+	}
+
+	uri, err := DecryptURI(cluster.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connecting doesn't wait for the cluster to answer.
+	pooled := &pooledClient{}
+	pooled.client, err = mongo.Connect(
+		context.TODO(),
+		options.Client().
+			ApplyURI(uri).
+			SetConnectTimeout(5*time.Second).
+			SetPoolMonitor(pooled.monitor()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	pooled.touch()
+	clusters[cluster.ID] = pooled
+	return pooled.client, nil
+}
+
+// evictIdleClusters disconnects the clients that have been idle for
+// clusterIdleTimeout, or all of them.
+func evictIdleClusters(all bool) {
+	clustersMu.Lock()
+	var idle []*mongo.Client
+	for id, pooled := range clusters {
+		lastUsed := time.Unix(0, pooled.lastUsed.Load())
+		if !all && (pooled.inUse.Load() > 0 || time.Since(lastUsed) < clusterIdleTimeout) {
+			continue
+		}
+
+		delete(clusters, id)
+		idle = append(idle, pooled.client)
+	}
+	clustersMu.Unlock()
+
+	for _, c := range idle {
+		if err := c.Disconnect(context.Background()); err != nil {
+			log.Printf("[database.evictIdleClusters] %v\n", err)
+		}
+	}
+}
+
+// startClusterEviction evicts idle clients until the returned function is
+// called, which then disconnects every client.
+func startClusterEviction() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(evictionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				evictIdleClusters(false)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		evictIdleClusters(true)
+	}
+}
+
+// ClusterID fingerprints the URI, so brands on the same cluster share a
+// client without the URI being stored in the clear. It is keyed, as a plain
+// hash of a URI, credentials included, could be brute forced offline.
+func ClusterID(uri string) (string, error) {
+	key, err := clusterKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uri))
+	return hex.EncodeToString(mac.Sum(nil)[:8]), nil
+}
+
+func clusterKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv(clusterKeyEnv))
+	if err != nil || len(key) != 32 {
+		return nil, ErrNoClusterKey
+	}
+
+	return key, nil
+}
+
+func clusterCipher() (cipher.AEAD, error) {
+	key, err := clusterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// EncryptURI seals the URI, which holds credentials, for storage.
+func EncryptURI(uri string) ([]byte, error) {
+	aead, err := clusterCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, []byte(uri), nil), nil
+}
+
+func DecryptURI(encrypted []byte) (string, error) {
+	aead, err := clusterCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(encrypted) < aead.NonceSize() {
+		return "", ErrCorruptedURI
+	}
+
+	nonce, sealed := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	uri, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrCorruptedURI
+	}
+
+	return string(uri), nil
+}
@@ -10,7 +10,8 @@ import (
 )
 
 var (
-	client *mongo.Client
+	client       *mongo.Client
+	stopClusters func()
 )
 
 func NewConnection(opts *options.ClientOptions) *mongo.Client {
@@ -20,27 +21,48 @@ func NewConnection(opts *options.ClientOptions) *mongo.Client {
 		log.Fatal(err)
 	}
 
+	stopClusters = startClusterEviction()
 	return client
 }
 
 func CloseConnection() {
+	stopClusters()
+
 	if err := client.Disconnect(context.Background()); err != nil {
 		log.Fatalf("[database.CloseConnection] %v\n", err)
 	}
 	client = nil
 }
 
+// GetDb returns any database on the shared cluster, by name. Use
+// Brand.Db for the database of a brand, which may have its own cluster.
+func GetDb(name string) *mongo.Database {
+	return client.Database(name)
+}
+
 func GetSystemDb() *mongo.Database {
 	return client.Database("system")
 }
 
 func GetBrandDb(ctx *fiber.Ctx) *mongo.Database {
+	if tx, ok := ctx.Locals("tx").(*Tx); ok {
+		return tx.db
+	}
+
 	dbName, ok := ctx.Locals("dbName").(string)
 	if !ok {
 		return nil
 	}
 
-	return client.Database(dbName)
+	// Set along with dbName for brands on a dedicated cluster.
+	cluster, _ := ctx.Locals("cluster").(*Cluster)
+	db, err := GetClusterDb(cluster, dbName)
+	if err != nil {
+		log.Printf("[database.GetBrandDb] %v\n", err)
+		return nil
+	}
+
+	return db
 }
 
 func Find[T any, R interface {
@@ -59,7 +81,7 @@ func Find[T any, R interface {
 		filter,
 	)*/
 
-	cursor, err := db.Collection(m.GetCollectionName()).Find(ctx, filter, opts...)
+	cursor, err := db.Collection(m.GetCollectionName()).Find(joinTx(db, ctx), scopeTrashed(ctx, filter), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -94,12 +116,22 @@ func FindOne[T any, R interface {
 	)*/
 
 	err := db.Collection(record.GetCollectionName()).
-		FindOne(ctx, filter, opts...).
+		FindOne(joinTx(db, ctx), scopeTrashed(ctx, filter), opts...).
 		Decode(&record)
 
 	return record, err
 }
 
+func Count[T CollectionModel](
+	db *mongo.Database,
+	ctx context.Context,
+	filter bson.M,
+	opts ...*options.CountOptions,
+) (int64, error) {
+	var m T // temporary
+	return db.Collection(m.GetCollectionName()).CountDocuments(joinTx(db, ctx), scopeTrashed(ctx, filter), opts...)
+}
+
 func InsertOne[T CollectionModel](
 	db *mongo.Database,
 	ctx context.Context,
@@ -113,7 +145,7 @@ func InsertOne[T CollectionModel](
 		doc,
 	)*/
 
-	return db.Collection(m.GetCollectionName()).InsertOne(ctx, doc, opts...)
+	return db.Collection(m.GetCollectionName()).InsertOne(joinTx(db, ctx), doc, opts...)
 }
 
 func InsertMany[T CollectionModel](
@@ -129,7 +161,7 @@ func InsertMany[T CollectionModel](
 		docs,
 	)*/
 
-	return db.Collection(m.GetCollectionName()).InsertMany(ctx, docs, opts...)
+	return db.Collection(m.GetCollectionName()).InsertMany(joinTx(db, ctx), docs, opts...)
 }
 
 func UpdateOne[T CollectionModel](
@@ -147,7 +179,7 @@ func UpdateOne[T CollectionModel](
 		update,
 	)*/
 
-	return db.Collection(m.GetCollectionName()).UpdateOne(ctx, filter, update, opts...)
+	return db.Collection(m.GetCollectionName()).UpdateOne(joinTx(db, ctx), filter, update, opts...)
 }
 
 func UpdateMany[T CollectionModel](
@@ -165,5 +197,5 @@ func UpdateMany[T CollectionModel](
 		update,
 	)*/
 
-	return db.Collection(m.GetCollectionName()).UpdateMany(ctx, filter, update, opts...)
+	return db.Collection(m.GetCollectionName()).UpdateMany(joinTx(db, ctx), filter, update, opts...)
 }
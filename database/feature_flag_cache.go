@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	redis2 "github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"white-label-crm/redis"
+)
+
+// featureFlagsKey is a hash of every live feature flag, as relaxed extended
+// JSON, by id. Flags are few and always evaluated together, so they're read
+// in one go.
+const featureFlagsKey = "feature_flags"
+
+// CachedFeatureFlags returns the cached flag documents.
+func CachedFeatureFlags(ctx context.Context) ([]string, error) {
+	return redis.Client.HVals(ctx, featureFlagsKey).Result()
+}
+
+// CacheFeatureFlag writes the flag document to the cache, or removes it if
+// the flag is soft deleted.
+func CacheFeatureFlag(ctx context.Context, doc map[string]interface{}) error {
+	id := doc["_id"].(primitive.ObjectID)
+	if _, deleted := doc["deletedAt"]; deleted {
+		return UncacheFeatureFlag(ctx, id)
+	}
+
+	encoded, err := bson.MarshalExtJSON(doc, false, false)
+	if err != nil {
+		return err
+	}
+
+	return redis.Client.HSet(ctx, featureFlagsKey, id.Hex(), string(encoded)).Err()
+}
+
+func UncacheFeatureFlag(ctx context.Context, id primitive.ObjectID) error {
+	return redis.Client.HDel(ctx, featureFlagsKey, id.Hex()).Err()
+}
+
+// ReconcileFeatureFlagCache replaces the cached flags with the ones in
+// `system.feature_flags`.
+func ReconcileFeatureFlagCache(ctx context.Context) error {
+	cursor, err := GetSystemDb().Collection("feature_flags").Find(
+		ctx,
+		bson.M{"deletedAt": bson.M{"$exists": false}},
+	)
+	if err != nil {
+		return err
+	}
+
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+
+	flags := map[string]interface{}{}
+	for _, doc := range docs {
+		encoded, err := bson.MarshalExtJSON(doc, false, false)
+		if err != nil {
+			return err
+		}
+
+		flags[doc["_id"].(primitive.ObjectID).Hex()] = string(encoded)
+	}
+
+	_, err = redis.Client.TxPipelined(
+		ctx,
+		func(pipe redis2.Pipeliner) error {
+			pipe.Del(ctx, featureFlagsKey)
+			if len(flags) > 0 {
+				pipe.HSet(ctx, featureFlagsKey, flags)
+			}
+
+			return nil
+		},
+	)
+
+	return err
+}
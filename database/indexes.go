@@ -0,0 +1,318 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Index describes an index a model needs. Keys map fields to 1, -1 or
+// "text":
+//
+//	Index{Keys: bson.D{{"email", 1}}, Unique: true}
+type Index struct {
+	// Name defaults to the name MongoDB would generate from the keys.
+	Name   string
+	Keys   bson.D
+	Unique bool
+	// Partial only indexes the documents matching the filter.
+	Partial bson.D
+	// ExpireAfter makes a TTL index; Keys must be a single date field.
+	ExpireAfter time.Duration
+}
+
+// IndexedModel is implemented by models that declare their indexes.
+type IndexedModel interface {
+	CollectionModel
+	Indexes() []Index
+}
+
+// TrashIndex covers soft deleted records only, which keeps the trash
+// listing fast without growing with the live records.
+func TrashIndex() Index {
+	return Index{
+		Keys:    bson.D{{Key: "deletedAt", Value: -1}},
+		Partial: bson.D{{Key: "deletedAt", Value: bson.M{"$exists": true}}},
+	}
+}
+
+// LiveUnique makes the fields unique among records that aren't soft
+// deleted. A partial filter can't express "deletedAt is missing", so
+// deletedAt is part of the key instead: live records all index it as null,
+// deleted ones have their own timestamp.
+func LiveUnique(fields ...string) Index {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: 1})
+	}
+
+	return Index{
+		Keys:   append(keys, bson.E{Key: "deletedAt", Value: 1}),
+		Unique: true,
+	}
+}
+
+func (i Index) name() string {
+	if len(i.Name) > 0 {
+		return i.Name
+	}
+
+	parts := make([]string, len(i.Keys))
+	for j, key := range i.Keys {
+		parts[j] = fmt.Sprintf("%s_%v", key.Key, key.Value)
+	}
+
+	return strings.Join(parts, "_")
+}
+
+func (i Index) model() mongo.IndexModel {
+	opts := options.Index().SetName(i.name())
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+
+	if i.Partial != nil {
+		opts.SetPartialFilterExpression(i.Partial)
+	}
+
+	if i.ExpireAfter > 0 {
+		opts.SetExpireAfterSeconds(int32(i.ExpireAfter / time.Second))
+	}
+
+	return mongo.IndexModel{Keys: i.Keys, Options: opts}
+}
+
+// key returns the key document as the server reports it, text fields
+// being folded into _fts/_ftsx.
+func (i Index) key() bson.D {
+	key := bson.D{}
+	text := false
+	for _, e := range i.Keys {
+		if e.Value != "text" {
+			key = append(key, e)
+			continue
+		}
+
+		if !text {
+			key = append(key, bson.E{Key: "_fts", Value: "text"}, bson.E{Key: "_ftsx", Value: 1})
+			text = true
+		}
+	}
+
+	return key
+}
+
+func (i Index) textFields() []string {
+	var fields []string
+	for _, e := range i.Keys {
+		if e.Value == "text" {
+			fields = append(fields, e.Key)
+		}
+	}
+
+	slices.Sort(fields)
+	return fields
+}
+
+type existingIndex struct {
+	Name               string   `bson:"name"`
+	Key                bson.Raw `bson:"key"`
+	Unique             bool     `bson:"unique"`
+	Partial            bson.Raw `bson:"partialFilterExpression"`
+	ExpireAfterSeconds *float64 `bson:"expireAfterSeconds"`
+	Weights            bson.M   `bson:"weights"`
+}
+
+// matches tells whether the index on the server is the one declared.
+func (i Index) matches(existing existingIndex) bool {
+	if i.Unique != existing.Unique || !sameDocument(i.key(), existing.Key) {
+		return false
+	}
+
+	if (i.Partial == nil) != (existing.Partial == nil) {
+		return false
+	}
+
+	if i.Partial != nil && !sameDocument(i.Partial, existing.Partial) {
+		return false
+	}
+
+	expireAfter := time.Duration(0)
+	if existing.ExpireAfterSeconds != nil {
+		expireAfter = time.Duration(*existing.ExpireAfterSeconds) * time.Second
+	}
+
+	if i.ExpireAfter != expireAfter {
+		return false
+	}
+
+	var weighted []string
+	for field := range existing.Weights {
+		weighted = append(weighted, field)
+	}
+	slices.Sort(weighted)
+
+	return slices.Equal(i.textFields(), weighted)
+}
+
+// sameDocument compares documents through relaxed extended JSON so an int
+// and an int32 holding the same number are equal.
+func sameDocument(a interface{}, b interface{}) bool {
+	left, err := bson.MarshalExtJSON(a, false, false)
+	if err != nil {
+		return false
+	}
+
+	right, err := bson.MarshalExtJSON(b, false, false)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(left, right)
+}
+
+type IndexOptions struct {
+	// DryRun only reports drift.
+	DryRun bool
+	// Rebuild drops and recreates indexes that differ from their
+	// declaration. Otherwise they're only reported.
+	Rebuild bool
+	// DropUnknown drops indexes no model declares.
+	DropUnknown bool
+}
+
+// IndexReport lists indexes as "<collection>.<index>".
+type IndexReport struct {
+	Database string
+	Missing  []string
+	Drifted  []string
+	Unknown  []string
+	Created  []string
+	Dropped  []string
+	Errors   []error
+}
+
+// HasDrift tells whether the database differs from the declarations.
+func (r *IndexReport) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Drifted) > 0 || len(r.Unknown) > 0
+}
+
+// EnsureIndexes reconciles the indexes of db with the ones declared by
+// models. Missing indexes are created unless opts.DryRun is set; failing to
+// build one (e.g. a unique index over duplicated data) doesn't stop the
+// others and is recorded in the report.
+func EnsureIndexes(ctx context.Context, db *mongo.Database, models []IndexedModel, opts IndexOptions) (*IndexReport, error) {
+	report := &IndexReport{Database: db.Name()}
+
+	for _, model := range models {
+		collection := db.Collection(model.GetCollectionName())
+
+		cursor, err := collection.Indexes().List(ctx)
+		if err != nil {
+			return report, err
+		}
+
+		var existing []existingIndex
+		if err := cursor.All(ctx, &existing); err != nil {
+			return report, err
+		}
+
+		current := map[string]existingIndex{}
+		for _, index := range existing {
+			current[index.Name] = index
+		}
+
+		declared := map[string]bool{"_id_": true}
+		for _, index := range model.Indexes() {
+			name := index.name()
+			qualified := collection.Name() + "." + name
+			declared[name] = true
+
+			found, ok := current[name]
+			if ok && index.matches(found) {
+				continue
+			}
+
+			if ok {
+				report.Drifted = append(report.Drifted, qualified)
+				if opts.DryRun || !opts.Rebuild {
+					continue
+				}
+
+				if _, err := collection.Indexes().DropOne(ctx, name); err != nil {
+					report.Errors = append(report.Errors, fmt.Errorf("%s: %w", qualified, err))
+					continue
+				}
+
+				report.Dropped = append(report.Dropped, qualified)
+			} else {
+				report.Missing = append(report.Missing, qualified)
+				if opts.DryRun {
+					continue
+				}
+			}
+
+			if _, err := collection.Indexes().CreateOne(ctx, index.model()); err != nil {
+				report.Errors = append(report.Errors, fmt.Errorf("%s: %w", qualified, err))
+				continue
+			}
+
+			report.Created = append(report.Created, qualified)
+		}
+
+		for _, index := range existing {
+			if declared[index.Name] {
+				continue
+			}
+
+			qualified := collection.Name() + "." + index.Name
+			report.Unknown = append(report.Unknown, qualified)
+			if opts.DryRun || !opts.DropUnknown {
+				continue
+			}
+
+			if _, err := collection.Indexes().DropOne(ctx, index.Name); err != nil {
+				report.Errors = append(report.Errors, fmt.Errorf("%s: %w", qualified, err))
+				continue
+			}
+
+			report.Dropped = append(report.Dropped, qualified)
+		}
+	}
+
+	return report, nil
+}
+
+// LogIndexReport writes the drift and changes of a report to the log.
+func LogIndexReport(report *IndexReport) {
+	for _, name := range report.Missing {
+		log.Printf("[database.EnsureIndexes] %s | Missing %s\n", report.Database, name)
+	}
+
+	for _, name := range report.Drifted {
+		log.Printf("[database.EnsureIndexes] %s | Drifted %s\n", report.Database, name)
+	}
+
+	for _, name := range report.Unknown {
+		log.Printf("[database.EnsureIndexes] %s | Unknown %s\n", report.Database, name)
+	}
+
+	for _, name := range report.Created {
+		log.Printf("[database.EnsureIndexes] %s | Created %s\n", report.Database, name)
+	}
+
+	for _, name := range report.Dropped {
+		log.Printf("[database.EnsureIndexes] %s | Dropped %s\n", report.Database, name)
+	}
+
+	for _, err := range report.Errors {
+		log.Printf("[database.EnsureIndexes] %s | %v\n", report.Database, err)
+	}
+}
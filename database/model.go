@@ -4,6 +4,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,11 +16,19 @@ type CollectionModel interface {
 
 	OnInserted(createdAt time.Time, updatedAt time.Time, updatedBy UserRelation)
 	OnUpdated(updatedAt time.Time, updatedBy UserRelation)
+	OnDeleted(deletedAt *time.Time)
 }
 
 type UserRelation struct {
-	ID   int    `json:"id" bson:"id"`
-	Name string `json:"name" bson:"name"`
+	ID   primitive.ObjectID `json:"id" bson:"id"`
+	Name string             `json:"name" bson:"name"`
+}
+
+// SystemUser is recorded as the author of changes made by the application
+// itself rather than a user.
+var SystemUser = UserRelation{
+	ID:   primitive.NilObjectID,
+	Name: "System",
 }
 
 type Model struct {
@@ -27,6 +37,9 @@ type Model struct {
 	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
 	UpdatedBy UserRelation       `json:"updatedBy" bson:"updatedBy"`
 	DeletedAt *time.Time         `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Version is incremented by every update made through Query, allowing
+	// optimistic concurrency checks with IfVersion.
+	Version int64 `json:"version" bson:"version"`
 }
 
 func NewModel(ctx *fiber.Ctx) Model {
@@ -35,6 +48,7 @@ func NewModel(ctx *fiber.Ctx) Model {
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		UpdatedBy: ctx.Locals("user").(UserRelation),
+		Version:   1,
 	}
 }
 
@@ -51,9 +65,35 @@ func (m *Model) OnInserted(createdAt time.Time, updatedAt time.Time, updatedBy U
 	m.CreatedAt = createdAt
 	m.UpdatedAt = updatedAt
 	m.UpdatedBy = updatedBy
+	m.Version = 1
 }
 
 func (m *Model) OnUpdated(updatedAt time.Time, updatedBy UserRelation) {
 	m.UpdatedAt = updatedAt
 	m.UpdatedBy = updatedBy
+	m.Version++
+}
+
+func (m *Model) OnDeleted(deletedAt *time.Time) {
+	m.DeletedAt = deletedAt
+}
+
+// IsDeleted tells whether the record is in the trash.
+func (m *Model) IsDeleted() bool {
+	return m.DeletedAt != nil
+}
+
+// ETag is the strong entity tag of the current version of the record.
+func (m *Model) ETag() string {
+	return strconv.Quote(strconv.FormatInt(m.Version, 10))
+}
+
+// ParseETag extracts the version from an entity tag produced by ETag.
+func ParseETag(tag string) (int64, error) {
+	unquoted, err := strconv.Unquote(strings.TrimSpace(tag))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(unquoted, 10, 64)
 }
@@ -2,17 +2,37 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrNoWhere is returned by the operations that would otherwise hit a
+	// whole collection, or an arbitrary document, for lack of a filter.
+	ErrNoWhere = errors.New("query has no Where conditions")
+	// ErrReservedField is returned when an update touches a field that
+	// EncodeUpdate maintains itself.
+	ErrReservedField = errors.New("field is maintained by the query")
+)
+
+// reservedFields are written by EncodeUpdate, keyed by operator.
+var reservedFields = map[string]string{
+	"$inc":         "version",
+	"$setOnInsert": "createdAt",
+}
+
 type Query struct {
-	set         *bson.M
-	unset       *bson.M
-	currentDate *bson.M
+	ops          map[string]bson.M
+	where        bson.M
+	arrayFilters []interface{}
+	upsert       bool
 
 	ctx *fiber.Ctx
 
@@ -21,77 +41,221 @@ type Query struct {
 	UpdatedBy UserRelation
 }
 
+// PushOptions are the modifiers of a $push with $each.
+type PushOptions struct {
+	Slice    *int
+	Sort     interface{}
+	Position *int
+}
+
 func NewQuery(ctx *fiber.Ctx) *Query {
 	return &Query{
 		ctx: ctx,
 	}
 }
 
-func (q *Query) Set(key string, value interface{}) *Query {
-	if q.set == nil {
-		q.set = &bson.M{}
+func (q *Query) op(operator string, key string, value interface{}) *Query {
+	if q.ops == nil {
+		q.ops = map[string]bson.M{}
 	}
 
-	(*q.set)[key] = value
+	if q.ops[operator] == nil {
+		q.ops[operator] = bson.M{}
+	}
+
+	q.ops[operator][key] = value
 
 	return q
 }
 
-func (q *Query) Unset(key ...string) *Query {
-	if q.unset == nil {
-		q.unset = &bson.M{}
-	}
+func (q *Query) Set(key string, value interface{}) *Query {
+	return q.op("$set", key, value)
+}
 
+func (q *Query) Unset(key ...string) *Query {
 	for _, k := range key {
-		(*q.unset)[k] = true
+		q.op("$unset", k, true)
 	}
 
 	return q
 }
 
 func (q *Query) CurrentDate(key string, value ...interface{}) *Query {
-	if q.currentDate == nil {
-		q.currentDate = &bson.M{}
+	if len(value) > 0 {
+		return q.op("$currentDate", key, value[0])
 	}
 
-	if len(value) > 0 {
-		(*q.currentDate)[key] = value[0]
-	} else {
-		(*q.currentDate)[key] = true
+	return q.op("$currentDate", key, true)
+}
+
+// SetOnInsert sets a field only when an upsert inserts a new document.
+func (q *Query) SetOnInsert(key string, value interface{}) *Query {
+	return q.op("$setOnInsert", key, value)
+}
+
+func (q *Query) Inc(key string, amount interface{}) *Query {
+	return q.op("$inc", key, amount)
+}
+
+func (q *Query) Mul(key string, factor interface{}) *Query {
+	return q.op("$mul", key, factor)
+}
+
+// Min only updates the field if value is less than the stored value.
+func (q *Query) Min(key string, value interface{}) *Query {
+	return q.op("$min", key, value)
+}
+
+// Max only updates the field if value is greater than the stored value.
+func (q *Query) Max(key string, value interface{}) *Query {
+	return q.op("$max", key, value)
+}
+
+func (q *Query) Rename(from string, to string) *Query {
+	return q.op("$rename", from, to)
+}
+
+// Push appends a single value to an array.
+func (q *Query) Push(key string, value interface{}) *Query {
+	return q.op("$push", key, value)
+}
+
+// PushEach appends values to an array, optionally sorting, slicing or
+// positioning them with opts.
+func (q *Query) PushEach(key string, values []interface{}, opts *PushOptions) *Query {
+	modifiers := bson.M{"$each": values}
+	if opts != nil {
+		if opts.Slice != nil {
+			modifiers["$slice"] = *opts.Slice
+		}
+
+		if opts.Sort != nil {
+			modifiers["$sort"] = opts.Sort
+		}
+
+		if opts.Position != nil {
+			modifiers["$position"] = *opts.Position
+		}
 	}
 
+	return q.op("$push", key, modifiers)
+}
+
+// AddToSet adds values to an array unless they are already present.
+func (q *Query) AddToSet(key string, values ...interface{}) *Query {
+	if len(values) == 1 {
+		return q.op("$addToSet", key, values[0])
+	}
+
+	return q.op("$addToSet", key, bson.M{"$each": values})
+}
+
+// Pull removes every element of an array matching the value or condition.
+func (q *Query) Pull(key string, condition interface{}) *Query {
+	return q.op("$pull", key, condition)
+}
+
+func (q *Query) PullAll(key string, values ...interface{}) *Query {
+	return q.op("$pullAll", key, values)
+}
+
+// ArrayFilters sets the filters for the `$[<identifier>]` positional
+// operators used in update keys.
+func (q *Query) ArrayFilters(filters ...interface{}) *Query {
+	q.arrayFilters = append(q.arrayFilters, filters...)
+
 	return q
 }
 
-func (q *Query) Encode() bson.M {
-	out := bson.M{}
-	if q.set != nil {
-		out["$set"] = *q.set
+// Upsert makes UpdateOne and FindOneAndUpdate insert a new document when
+// nothing matches. Fields that should only be written on insert can be set
+// with SetOnInsert.
+func (q *Query) Upsert() *Query {
+	q.upsert = true
+
+	return q
+}
+
+// Where adds a condition to the filter used by UpdateOne, on top of the
+// record's own query filter.
+func (q *Query) Where(key string, value interface{}) *Query {
+	if q.where == nil {
+		q.where = bson.M{}
 	}
 
-	if q.unset != nil {
-		out["$unset"] = *q.unset
+	q.where[key] = value
+
+	return q
+}
+
+// IfVersion makes the update only apply when the stored record is still at
+// the given version.
+func (q *Query) IfVersion(version int64) *Query {
+	if version == 0 {
+		// Records written before versioning have no version field.
+		return q.Where("version", bson.M{"$in": bson.A{0, nil}})
 	}
 
-	if q.currentDate != nil {
-		out["$currentDate"] = *q.currentDate
+	return q.Where("version", version)
+}
+
+func (q *Query) Encode() bson.M {
+	out := bson.M{}
+	for operator, fields := range q.ops {
+		copied := make(bson.M, len(fields))
+		for k, v := range fields {
+			copied[k] = v
+		}
+
+		out[operator] = copied
 	}
 
 	return out
 }
 
-func (q *Query) EncodeInsert() (*mongo.Database, bson.M) {
-	db, out := q.EncodeUpdate()
+// EncodeInsert builds the document to insert for the record: all of its
+// fields, overridden by any values given to Set, stamped with the audit
+// fields of the request's user.
+func (q *Query) EncodeInsert(record CollectionModel) (*mongo.Database, bson.M, error) {
+	raw, err := bson.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	q.CreatedAt = time.Now()
-	out["$set"].(bson.M)["createdAt"] = q.CreatedAt
+	doc := bson.M{}
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
 
 	// There are no operators ($set, $currentDate, etc.) for insert queries.
-	return db, out["$set"].(bson.M)
+	for key, value := range q.ops["$set"] {
+		setPath(doc, key, value)
+	}
+
+	if id, ok := doc["_id"].(primitive.ObjectID); !ok || id.IsZero() {
+		doc["_id"] = primitive.NewObjectID()
+	}
+
+	q.CreatedAt = time.Now()
+	q.UpdatedAt = q.CreatedAt
+	q.UpdatedBy = q.ctx.Locals("user").(UserRelation)
+
+	doc["createdAt"] = q.CreatedAt
+	doc["updatedAt"] = q.UpdatedAt
+	doc["updatedBy"] = q.UpdatedBy
+	doc["version"] = 1
+
+	return GetBrandDb(q.ctx), doc, nil
 }
 
-func (q *Query) EncodeUpdate() (*mongo.Database, bson.M) {
+func (q *Query) EncodeUpdate() (*mongo.Database, bson.M, error) {
 	out := q.Encode()
+	for operator, key := range reservedFields {
+		if _, ok := q.ops[operator][key]; ok {
+			return nil, nil, fmt.Errorf("%w: %s.%s", ErrReservedField, operator, key)
+		}
+	}
+
 	set, ok := out["$set"].(bson.M)
 	if !ok {
 		set = bson.M{}
@@ -104,6 +268,14 @@ func (q *Query) EncodeUpdate() (*mongo.Database, bson.M) {
 	q.UpdatedBy = q.ctx.Locals("user").(UserRelation)
 	set["updatedBy"] = q.UpdatedBy
 
+	inc, ok := out["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+		out["$inc"] = inc
+	}
+
+	inc["version"] = 1
+
 	// For when we do an upsert.
 	setOnInsert, ok := out["$setOnInsert"].(bson.M)
 	if !ok {
@@ -114,7 +286,7 @@ func (q *Query) EncodeUpdate() (*mongo.Database, bson.M) {
 	q.CreatedAt = time.Now()
 	setOnInsert["createdAt"] = q.CreatedAt
 
-	return GetBrandDb(q.ctx), out
+	return GetBrandDb(q.ctx), out, nil
 }
 
 func (q *Query) InsertOne(
@@ -122,31 +294,147 @@ func (q *Query) InsertOne(
 	record CollectionModel,
 	opts ...*options.InsertOneOptions,
 ) (*mongo.InsertOneResult, error) {
-	db, doc := q.EncodeInsert()
-	result, err := db.Collection(record.GetCollectionName()).InsertOne(ctx, doc, opts...)
+	db, doc, err := q.EncodeInsert(record)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.Collection(record.GetCollectionName()).InsertOne(joinTx(db, ctx), doc, opts...)
 	if err != nil {
 		return result, err
 	}
 
-	record.SetPrimaryKey(result.InsertedID)
-	record.OnInserted(q.CreatedAt, q.UpdatedAt, q.UpdatedBy)
+	if err := q.onInserted(record, doc); err != nil {
+		return result, err
+	}
 
 	return result, nil
 }
 
+// InsertManyResult reports the outcome of every record given to
+// InsertMany, by index.
+type InsertManyResult struct {
+	InsertedIDs []interface{}
+	Errors      map[int]error
+}
+
+var ErrNotInserted = errors.New("not inserted: an earlier document failed")
+
+// InsertMany inserts the records in one batch. When ordered, the batch
+// stops at the first failure and every later record reports
+// ErrNotInserted; otherwise the remaining records are still inserted. Only
+// errors unrelated to individual documents are returned as err.
+func (q *Query) InsertMany(
+	ctx context.Context,
+	records []CollectionModel,
+	ordered bool,
+	opts ...*options.InsertManyOptions,
+) (*InsertManyResult, error) {
+	out := &InsertManyResult{
+		InsertedIDs: make([]interface{}, len(records)),
+		Errors:      map[int]error{},
+	}
+
+	if len(records) == 0 {
+		return out, nil
+	}
+
+	var db *mongo.Database
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		var err error
+		var doc bson.M
+		if db, doc, err = q.EncodeInsert(record); err != nil {
+			return nil, err
+		}
+
+		docs[i] = doc
+	}
+
+	_, err := db.Collection(records[0].GetCollectionName()).InsertMany(
+		joinTx(db, ctx),
+		docs,
+		append([]*options.InsertManyOptions{options.InsertMany().SetOrdered(ordered)}, opts...)...,
+	)
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			return nil, err
+		}
+
+		for _, writeErr := range bulkErr.WriteErrors {
+			out.Errors[writeErr.Index] = writeErr
+		}
+
+		if ordered {
+			for i := bulkErr.WriteErrors[0].Index + 1; i < len(records); i++ {
+				out.Errors[i] = ErrNotInserted
+			}
+		}
+	}
+
+	for i, record := range records {
+		if _, failed := out.Errors[i]; failed {
+			continue
+		}
+
+		doc := docs[i].(bson.M)
+		if err := q.onInserted(record, doc); err != nil {
+			out.Errors[i] = err
+			continue
+		}
+
+		out.InsertedIDs[i] = doc["_id"]
+	}
+
+	return out, nil
+}
+
+// onInserted brings the record in line with the document that was inserted.
+func (q *Query) onInserted(record CollectionModel, doc bson.M) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	if err := bson.Unmarshal(raw, record); err != nil {
+		return err
+	}
+
+	record.SetPrimaryKey(doc["_id"])
+	record.OnInserted(q.CreatedAt, q.UpdatedAt, q.UpdatedBy)
+
+	return nil
+}
+
 func (q *Query) UpdateOne(
 	ctx context.Context,
 	record CollectionModel,
 	opts ...*options.UpdateOptions,
 ) (*mongo.UpdateResult, error) {
-	db, update := q.EncodeUpdate()
-	result, err := db.Collection(record.GetCollectionName()).UpdateOne(ctx, record.GetQueryFilter(), update, opts...)
+	filter, err := q.filter(record)
+	if err != nil {
+		return nil, err
+	}
+
+	db, update, err := q.EncodeUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.Collection(record.GetCollectionName()).UpdateOne(
+		joinTx(db, ctx),
+		filter,
+		update,
+		append([]*options.UpdateOptions{q.updateOptions()}, opts...)...,
+	)
 	if err != nil {
 		return result, err
 	}
 
 	if result.UpsertedCount == 1 {
 		record.SetPrimaryKey(result.UpsertedID)
+		record.OnInserted(q.CreatedAt, q.UpdatedAt, q.UpdatedBy)
 	}
 
 	if result.ModifiedCount == 1 {
@@ -155,3 +443,193 @@ func (q *Query) UpdateOne(
 
 	return result, nil
 }
+
+// UpdateMany applies the update to every document of the model's
+// collection matching the Where conditions. Trashed documents are left
+// alone unless ctx says otherwise (see WithTrashed).
+func (q *Query) UpdateMany(
+	ctx context.Context,
+	model CollectionModel,
+	opts ...*options.UpdateOptions,
+) (*mongo.UpdateResult, error) {
+	filter, err := q.whereFilter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db, update, err := q.EncodeUpdate()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.Collection(model.GetCollectionName()).UpdateMany(
+		joinTx(db, ctx),
+		filter,
+		update,
+		append([]*options.UpdateOptions{q.updateOptions()}, opts...)...,
+	)
+}
+
+// FindOneAndUpdate atomically updates the record and decodes the document
+// back into it - as it is after the update unless opts say otherwise.
+func (q *Query) FindOneAndUpdate(
+	ctx context.Context,
+	record CollectionModel,
+	opts ...*options.FindOneAndUpdateOptions,
+) error {
+	findOpts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetUpsert(q.upsert)
+	if len(q.arrayFilters) > 0 {
+		findOpts.SetArrayFilters(options.ArrayFilters{Filters: q.arrayFilters})
+	}
+
+	filter, err := q.filter(record)
+	if err != nil {
+		return err
+	}
+
+	db, update, err := q.EncodeUpdate()
+	if err != nil {
+		return err
+	}
+
+	return db.Collection(record.GetCollectionName()).
+		FindOneAndUpdate(
+			joinTx(db, ctx),
+			filter,
+			update,
+			append([]*options.FindOneAndUpdateOptions{findOpts}, opts...)...,
+		).
+		Decode(record)
+}
+
+// DeleteOne deletes the first document of the model's collection matching
+// the Where conditions, trashed ones excluded unless ctx says otherwise.
+func (q *Query) DeleteOne(
+	ctx context.Context,
+	model CollectionModel,
+	opts ...*options.DeleteOptions,
+) (*mongo.DeleteResult, error) {
+	filter, err := q.whereFilter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := GetBrandDb(q.ctx)
+	return db.Collection(model.GetCollectionName()).DeleteOne(joinTx(db, ctx), filter, opts...)
+}
+
+func (q *Query) updateOptions() *options.UpdateOptions {
+	opts := options.Update().SetUpsert(q.upsert)
+	if len(q.arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: q.arrayFilters})
+	}
+
+	return opts
+}
+
+// filter targets the record, narrowed by the Where conditions. A record
+// without an id (e.g. one about to be upserted) is matched by the Where
+// conditions alone, and must have some: an upsert would otherwise insert
+// a document with a zero id.
+func (q *Query) filter(record CollectionModel) (bson.M, error) {
+	filter := record.GetQueryFilter()
+	if id, ok := filter["_id"].(primitive.ObjectID); ok && id.IsZero() {
+		if len(q.where) > 0 {
+			delete(filter, "_id")
+		} else if q.upsert {
+			return nil, ErrNoWhere
+		}
+	}
+
+	for k, v := range q.where {
+		filter[k] = v
+	}
+
+	return filter, nil
+}
+
+// setPath sets a value in a document, following dotted keys into nested
+// documents.
+func setPath(doc bson.M, key string, value interface{}) {
+	head, rest, nested := strings.Cut(key, ".")
+	if !nested {
+		doc[head] = value
+		return
+	}
+
+	child, ok := doc[head].(bson.M)
+	if !ok {
+		child = bson.M{}
+		doc[head] = child
+	}
+
+	setPath(child, rest, value)
+}
+
+// whereFilter is the filter of the operations that don't target a record.
+// It refuses to match everything.
+func (q *Query) whereFilter(ctx context.Context) (bson.M, error) {
+	if len(q.where) == 0 {
+		return nil, ErrNoWhere
+	}
+
+	return scopeTrashed(ctx, q.where), nil
+}
+
+// SoftDelete marks the record as deleted by setting deletedAt.
+func (q *Query) SoftDelete(
+	ctx context.Context,
+	record CollectionModel,
+	opts ...*options.UpdateOptions,
+) (*mongo.UpdateResult, error) {
+	deletedAt := time.Now()
+	result, err := q.Set("deletedAt", deletedAt).
+		Where("deletedAt", bson.M{"$exists": false}).
+		UpdateOne(ctx, record, opts...)
+	if err != nil {
+		return result, err
+	}
+
+	if result.ModifiedCount == 1 {
+		record.OnDeleted(&deletedAt)
+	}
+
+	return result, nil
+}
+
+// Restore undoes SoftDelete.
+func (q *Query) Restore(
+	ctx context.Context,
+	record CollectionModel,
+	opts ...*options.UpdateOptions,
+) (*mongo.UpdateResult, error) {
+	result, err := q.Unset("deletedAt").
+		Where("deletedAt", bson.M{"$exists": true}).
+		UpdateOne(ctx, record, opts...)
+	if err != nil {
+		return result, err
+	}
+
+	if result.ModifiedCount == 1 {
+		record.OnDeleted(nil)
+	}
+
+	return result, nil
+}
+
+// HardDelete permanently removes the record.
+func (q *Query) HardDelete(
+	ctx context.Context,
+	record CollectionModel,
+	opts ...*options.DeleteOptions,
+) (*mongo.DeleteResult, error) {
+	filter, err := q.filter(record)
+	if err != nil {
+		return nil, err
+	}
+
+	db := GetBrandDb(q.ctx)
+	return db.Collection(record.GetCollectionName()).DeleteOne(joinTx(db, ctx), filter, opts...)
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"sync"
+)
+
+// Tx is a transaction bound to a brand database. It is a context, so it can
+// be passed anywhere a context.Context is expected.
+type Tx struct {
+	mongo.SessionContext
+	db *mongo.Database
+}
+
+var ErrNoBrandDb = errors.New("request has no brand database")
+
+// transactions maps the database handle of every running transaction to
+// its session, so the helpers in this package join it automatically.
+var transactions sync.Map
+
+// Db returns the brand database handle bound to the transaction.
+func (tx *Tx) Db() *mongo.Database {
+	return tx.db
+}
+
+// WithTransaction runs fn in a transaction on the request's brand database.
+// While fn runs, GetBrandDb returns the transaction's database and every
+// operation made through it - Find, FindOne, InsertOne, UpdateOne, Query,
+// etc. - joins the transaction, whatever context it is given. The whole
+// callback is retried on transient transaction errors, so it must be safe
+// to run more than once.
+func WithTransaction(ctx *fiber.Ctx, fn func(tx *Tx) error) error {
+	if tx, ok := ctx.Locals("tx").(*Tx); ok {
+		// Already in a transaction; nested calls join it.
+		return fn(tx)
+	}
+
+	brandDb := GetBrandDb(ctx)
+	if brandDb == nil {
+		return ErrNoBrandDb
+	}
+
+	// The brand may be on its own cluster.
+	session, err := brandDb.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	// A fresh handle, so only work done through it joins the transaction.
+	db := brandDb.Client().Database(brandDb.Name())
+
+	_, err = session.WithTransaction(
+		ctx.UserContext(),
+		func(sc mongo.SessionContext) (interface{}, error) {
+			tx := &Tx{SessionContext: sc, db: db}
+
+			transactions.Store(db, sc)
+			ctx.Locals("tx", tx)
+			defer func() {
+				ctx.Locals("tx", nil)
+				transactions.Delete(db)
+			}()
+
+			return nil, fn(tx)
+		},
+		options.Transaction().
+			SetReadConcern(readconcern.Snapshot()).
+			SetWriteConcern(writeconcern.Majority()),
+	)
+
+	return err
+}
+
+// joinTx returns a context that takes part in the transaction running on
+// db, if there is one.
+func joinTx(db *mongo.Database, ctx context.Context) context.Context {
+	if _, ok := ctx.(mongo.SessionContext); ok {
+		return ctx
+	}
+
+	sc, ok := transactions.Load(db)
+	if !ok {
+		return ctx
+	}
+
+	return mongo.NewSessionContext(ctx, sc.(mongo.SessionContext))
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type trashedScope int
+
+const (
+	withoutTrashed trashedScope = iota
+	withTrashed
+	onlyTrashed
+)
+
+type trashedScopeKey struct{}
+
+// WithTrashed makes Find and FindOne include soft-deleted records.
+func WithTrashed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trashedScopeKey{}, withTrashed)
+}
+
+// OnlyTrashed makes Find and FindOne return soft-deleted records only.
+func OnlyTrashed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trashedScopeKey{}, onlyTrashed)
+}
+
+// scopeTrashed adds the soft-delete condition for the context's scope to a
+// copy of the filter. Filters that already mention deletedAt are left as is.
+func scopeTrashed(ctx context.Context, filter bson.M) bson.M {
+	if _, ok := filter["deletedAt"]; ok {
+		return filter
+	}
+
+	scope, _ := ctx.Value(trashedScopeKey{}).(trashedScope)
+	if scope == withTrashed {
+		return filter
+	}
+
+	scoped := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		scoped[k] = v
+	}
+
+	scoped["deletedAt"] = bson.M{"$exists": scope == onlyTrashed}
+	return scoped
+}
@@ -8,238 +8,307 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
-	"slices"
+	"time"
 	"white-label-crm/redis"
 )
 
+const (
+	// resumeTokenKey holds the position of the last processed event. It
+	// lives next to the cache it describes: losing one means losing both.
+	// Bumped along with the cache layout, forcing a reconcile.
+	resumeTokenKey = "watcher:system:v3:resumeToken"
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute
+)
+
+// Server error codes meaning the resume token can't be used anymore.
+var staleTokenCodes = []int{
+	260, // InvalidResumeToken
+	286, // ChangeStreamHistoryLost
+	280, // ChangeStreamFatalError
+}
+
 type Watcher struct {
 	client *mongo.Client
 	db     *mongo.Database
-	stream *mongo.ChangeStream
 	cancel context.CancelFunc
+	done   chan struct{}
+	config WatcherConfig
 }
 
-func NewWatcher(client *mongo.Client) *Watcher {
+type WatcherConfig struct {
+	// OnBrandInserted is called for every new brand once it's cached. It
+	// must not block the change stream.
+	OnBrandInserted func(id primitive.ObjectID)
+	// Election makes only its leader watch, so instances don't race each
+	// other writing the cache. Without it the watcher always runs.
+	Election *redis.Election
+}
+
+// NewWatcher keeps the brand and feature flag caches in sync with
+// `system.brands` and `system.feature_flags` until CloseConnection is
+// called. Watching resumes where the last run stopped;
+// when that's no longer possible the whole cache is reconciled instead.
+func NewWatcher(client *mongo.Client, config WatcherConfig) *Watcher {
+	// Create a context that will let the goroutine be stopped
+	ctx, cancel := context.WithCancel(context.Background())
+
 	watcher := &Watcher{
 		client: client,
 		db:     GetSystemDb(),
+		cancel: cancel,
+		done:   make(chan struct{}),
+		config: config,
 	}
 
-	// Watch for any document changes in `system.brands`
-	stream, err := watcher.db.Watch(
-		context.Background(),
-		mongo.Pipeline{
-			{
-				{
-					"$match", bson.M{
-						"ns.db":   "system",
-						"ns.coll": "brands",
-						"operationType": bson.M{
-							"$in": bson.A{"insert", "update", "replace", "delete"},
-						},
-					},
-				},
-			},
-		},
-	)
-	if err != nil {
-		log.Fatalf("[watcher.NewConnection] %v\n", err)
-	}
+	go func() {
+		defer close(watcher.done)
 
-	// Create a context that will let the goroutine be stopped
-	ctx, cancel := context.WithCancel(context.Background())
-	watcher.cancel = cancel
-	watcher.stream = stream
+		if config.Election == nil {
+			watcher.run(ctx)
+			return
+		}
+
+		config.Election.Run(ctx, watcher.run)
+	}()
 
-	go watcher.process(ctx)
 	return watcher
 }
 
 func (w *Watcher) CloseConnection() {
-	if w.stream == nil {
-		return
-	}
-
-	// Stop processing the change stream
+	// Stop processing the change stream, which closes it
 	w.cancel()
+	<-w.done
+}
 
-	// Close the change stream
-	err := w.stream.Close(context.Background())
-	if err != nil {
-		log.Fatalf("[watcher.CloseConnection] %v\n", err)
+// run watches until the context is cancelled, reopening the change stream
+// with an increasing delay whenever it fails.
+func (w *Watcher) run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		processed, err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if processed {
+			backoff = minBackoff
+		}
+
+		log.Printf("[Watcher.run] Restarting in %v | %v\n", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxBackoff)
 	}
 }
 
-func (w *Watcher) process(ctx context.Context) {
-	for w.stream.Next(ctx) {
+// watch opens the change stream and processes it until it fails. It reports
+// whether any event was processed, to reset the backoff.
+func (w *Watcher) watch(ctx context.Context) (bool, error) {
+	stream, err := w.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := stream.Close(context.Background()); err != nil {
+			log.Printf("[Watcher.watch] %v\n", err)
+		}
+	}()
+
+	processed := false
+	for stream.Next(ctx) {
 		var data changeEvent
-		if err := w.stream.Decode(&data); err != nil {
-			log.Printf("[Watcher.process] Error: %v\n", err)
+		if err := stream.Decode(&data); err != nil {
+			log.Printf("[Watcher.watch] Error: %v\n", err)
 			continue
 		}
 
-		switch data.OperationType {
-		case OperationInsert:
-			brand := map[string]string{
-				"_id":    data.DocumentKey.ID.Hex(),
-				"name":   data.FullDocument["name"].(string),
-				"slug":   data.FullDocument["slug"].(string),
-				"domain": data.FullDocument["domain"].(string),
-			}
-
-			err := w.insertCachedBrand(ctx, data.DocumentKey.ID, brand)
-			if err != nil {
-				log.Printf("[Watcher.process] Insert | %v\n", err)
-			}
-		case OperationUpdate:
-			fallthrough
-		case OperationReplace:
-			err := w.updateCachedBrand(ctx, data)
-			if err != nil {
-				log.Printf("[Watcher.process] Update | %v\n", err)
-			}
-		case OperationDelete:
-			err := w.deleteCachedBrand(ctx, data)
-			if err != nil {
-				log.Printf("[Watcher.process] Delete | %v\n", err)
-			}
-		default:
-			log.Printf("[Watcher.process] Unhandled event: %v\n", data.OperationType)
+		w.process(ctx, data)
+		processed = true
+
+		if err := w.saveResumeToken(ctx, stream.ResumeToken()); err != nil {
+			log.Printf("[Watcher.watch] %v\n", err)
 		}
 	}
-}
 
-func wasSoftDeleted(data changeEvent) bool {
-	_, ok := data.UpdateDescription.UpdatedFields["deletedAt"].(primitive.DateTime)
-	return ok
-}
+	// Don't try resuming from a position that's gone.
+	if isStaleToken(stream.Err()) {
+		if err := redis.Client.Del(ctx, resumeTokenKey).Err(); err != nil {
+			log.Printf("[Watcher.watch] %v\n", err)
+		}
+	}
 
-func wasRestored(data changeEvent) bool {
-	return slices.Contains(data.UpdateDescription.RemovedFields, "deletedAt")
-}
+	if stream.Err() == nil {
+		return processed, errors.New("change stream closed")
+	}
 
-func getChanges(data changeEvent) map[string]string {
-	changes := map[string]string{}
+	return processed, stream.Err()
+}
 
-	if name, hasChanged := data.UpdateDescription.UpdatedFields["name"].(string); hasChanged {
-		changes["name"] = name
+// open resumes the change stream from the saved token. Without a usable
+// token a new stream is started and the cache reconciled, in that order, so
+// no change made during the reconcile is missed.
+func (w *Watcher) open(ctx context.Context) (*mongo.ChangeStream, error) {
+	token, err := redis.Client.Get(ctx, resumeTokenKey).Bytes()
+	if err != nil && !errors.Is(err, redis2.Nil) {
+		return nil, err
 	}
 
-	return changes
-}
+	if len(token) > 0 {
+		stream, err := w.db.Watch(ctx, systemPipeline(), streamOptions().SetStartAfter(bson.Raw(token)))
+		if err == nil {
+			return stream, nil
+		}
 
-func (w *Watcher) insertCachedBrand(ctx context.Context, id primitive.ObjectID, brand map[string]string) error {
-	_, err := redis.Client.TxPipelined(
-		ctx,
-		func(pipe redis2.Pipeliner) error {
-			key := fmt.Sprintf("brands:%v", brand["domain"])
-			for k, v := range brand {
-				pipe.HSet(ctx, key, k, v)
-			}
-
-			// For reverse lookup
-			pipe.Set(
-				ctx,
-				fmt.Sprintf("brands:$id:%s", id.Hex()),
-				brand["domain"],
-				0,
-			)
-
-			return nil
-		},
-	)
+		if !isStaleToken(err) {
+			return nil, err
+		}
 
-	return err
-}
+		log.Printf("[Watcher.open] Resume token expired, reconciling | %v\n", err)
+	}
 
-func (w *Watcher) updateCachedBrand(ctx context.Context, data changeEvent) error {
-	if wasSoftDeleted(data) {
-		return w.deleteCachedBrand(ctx, data)
+	stream, err := w.db.Watch(ctx, systemPipeline(), streamOptions())
+	if err != nil {
+		return nil, err
 	}
 
-	if wasRestored(data) {
-		return w.restoreCachedBrand(ctx, data)
+	if err := ReconcileBrandCache(ctx); err != nil {
+		_ = stream.Close(context.Background())
+		return nil, fmt.Errorf("reconcile: %w", err)
 	}
 
-	// If the domain changed, the keys need to be updated.
-	// Just delete the old cached data & recreate it.
-	if _, hasChanged := data.UpdateDescription.UpdatedFields["domain"].(string); hasChanged {
-		if err := w.deleteCachedBrand(ctx, data); err != nil {
-			return err
-		}
+	if err := ReconcileFeatureFlagCache(ctx); err != nil {
+		_ = stream.Close(context.Background())
+		return nil, fmt.Errorf("reconcile feature flags: %w", err)
+	}
 
-		return w.restoreCachedBrand(ctx, data)
+	if err := w.saveResumeToken(ctx, stream.ResumeToken()); err != nil {
+		log.Printf("[Watcher.open] %v\n", err)
 	}
 
-	// Get a list of changes that we care about.
-	changes := getChanges(data)
-	if len(changes) == 0 {
+	return stream, nil
+}
+
+func (w *Watcher) saveResumeToken(ctx context.Context, token bson.Raw) error {
+	if token == nil {
 		return nil
 	}
 
-	domain, err := redis.Client.Get(ctx, fmt.Sprintf("brands:$id:%s", data.DocumentKey.ID.Hex())).Result()
-	if err != nil {
-		if errors.Is(err, redis2.Nil) {
-			return nil
-		}
+	return redis.Client.Set(ctx, resumeTokenKey, []byte(token), 0).Err()
+}
 
-		return err
+func isStaleToken(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
 	}
 
-	_, err = redis.Client.TxPipelined(
-		ctx,
-		func(pipe redis2.Pipeliner) error {
-			key := fmt.Sprintf("brands:%s", domain)
-			for k, v := range changes {
-				pipe.HSet(ctx, key, k, v)
-			}
+	for _, code := range staleTokenCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
 
-			return nil
-		},
-	)
+	return false
+}
 
-	return err
+// streamOptions have updates carry the whole brand as it is after them.
+func streamOptions() *options.ChangeStreamOptions {
+	return options.ChangeStream().SetFullDocument(options.UpdateLookup)
 }
 
-func (w *Watcher) restoreCachedBrand(ctx context.Context, data changeEvent) error {
-	var brand bson.M
-	err := GetSystemDb().Collection("brands").
-		FindOne(ctx, bson.M{"_id": data.DocumentKey.ID}).
-		Decode(&brand)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil
+// systemPipeline matches any document change in the watched collections.
+func systemPipeline() mongo.Pipeline {
+	return mongo.Pipeline{
+		{
+			{
+				Key: "$match", Value: bson.M{
+					"ns.db":   "system",
+					"ns.coll": bson.M{"$in": bson.A{"brands", "feature_flags"}},
+					"operationType": bson.M{
+						"$in": bson.A{"insert", "update", "replace", "delete"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// process applies a single event to the cache. A malformed document must
+// not stop the watcher, so panics are logged and the event skipped.
+func (w *Watcher) process(ctx context.Context, data changeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[Watcher.process] Skipped %v event for %s | %v\n", data.OperationType, data.DocumentKey.ID.Hex(), r)
 		}
+	}()
 
-		return err
+	if data.Namespace.Collection == "feature_flags" {
+		w.processFeatureFlag(ctx, data)
+		return
 	}
 
-	return w.insertCachedBrand(
-		ctx,
-		brand["_id"].(primitive.ObjectID),
-		map[string]string{
-			"_id":    brand["_id"].(primitive.ObjectID).Hex(),
-			"name":   brand["name"].(string),
-			"slug":   brand["slug"].(string),
-			"domain": brand["domain"].(string),
-		},
-	)
+	switch data.OperationType {
+	case OperationInsert:
+		err := CacheBrand(ctx, data.FullDocument)
+		if err != nil {
+			log.Printf("[Watcher.process] Insert | %v\n", err)
+		}
+
+		if w.config.OnBrandInserted != nil {
+			w.config.OnBrandInserted(data.DocumentKey.ID)
+		}
+	case OperationUpdate:
+		fallthrough
+	case OperationReplace:
+		err := w.updateCachedBrand(ctx, data)
+		if err != nil {
+			log.Printf("[Watcher.process] Update | %v\n", err)
+		}
+	case OperationDelete:
+		err := UncacheBrand(ctx, data.DocumentKey.ID)
+		if err != nil {
+			log.Printf("[Watcher.process] Delete | %v\n", err)
+		}
+	default:
+		log.Printf("[Watcher.process] Unhandled event: %v\n", data.OperationType)
+	}
 }
 
-func (w *Watcher) deleteCachedBrand(ctx context.Context, data changeEvent) error {
-	// Lookup (and delete) the domain from _id
-	domain, err := redis.Client.GetDel(ctx, fmt.Sprintf("brands:$id:%s", data.DocumentKey.ID.Hex())).Result()
+// processFeatureFlag applies a feature flag event to the cache.
+func (w *Watcher) processFeatureFlag(ctx context.Context, data changeEvent) {
+	var err error
+	switch {
+	case data.OperationType == OperationDelete || data.FullDocument == nil:
+		err = UncacheFeatureFlag(ctx, data.DocumentKey.ID)
+	default:
+		err = CacheFeatureFlag(ctx, data.FullDocument)
+	}
+
 	if err != nil {
-		if errors.Is(err, redis2.Nil) {
-			return nil
-		}
+		log.Printf("[Watcher.processFeatureFlag] %v | %v\n", data.OperationType, err)
+	}
+}
+
+// updateCachedBrand recaches the brand as it is now, which covers changed
+// domains as well as soft deletes and restores.
+func (w *Watcher) updateCachedBrand(ctx context.Context, data changeEvent) error {
+	// The brand was deleted since the update.
+	if data.FullDocument == nil {
+		return UncacheBrand(ctx, data.DocumentKey.ID)
+	}
 
-		return err
+	if _, deleted := data.FullDocument["deletedAt"]; deleted {
+		return UncacheBrand(ctx, data.DocumentKey.ID)
 	}
 
-	// Delete brand info
-	return redis.Client.Del(ctx, fmt.Sprintf("brands:%s", domain)).Err()
+	return CacheBrand(ctx, data.FullDocument)
 }
 
 type OperationType string
@@ -49,6 +49,20 @@ func Hash(password string, opts *Argon2Options) (string, error) {
 	return encodeArgon2(hash, salt, opts), nil
 }
 
+// Password hashes a password with the Password* parameters.
+func Password(password string) (string, error) {
+	return Hash(
+		password,
+		&Argon2Options{
+			Time:       PasswordTime,
+			Memory:     PasswordMemory,
+			Threads:    PasswordThreads,
+			SaltLength: PasswordSaltLength,
+			KeyLength:  PasswordKeyLength,
+		},
+	)
+}
+
 // Compare takes in a password (typically user-provided) and an
 // encodedPassword (a password that's previously hashed with Hash
 // - typically stored in the database) and returns nil if the passwords match.
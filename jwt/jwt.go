@@ -0,0 +1,209 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Algorithm string
+
+const (
+	AlgorithmHS256 Algorithm = "HS256"
+	AlgorithmEdDSA Algorithm = "EdDSA"
+)
+
+var (
+	ErrMalformed         = errors.New("malformed token")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrInvalidAlgorithm  = errors.New("invalid algorithm")
+	ErrInvalidAudience   = errors.New("invalid audience")
+	ErrExpired           = errors.New("token expired")
+	ErrNotYetValid       = errors.New("token not yet valid")
+	ErrMissingSigningKey = errors.New("missing signing key")
+)
+
+// Key holds the material for a single algorithm. HS256 keys only use
+// Secret, EdDSA keys use PrivateKey for signing and PublicKey for
+// verification.
+type Key struct {
+	ID         string
+	Algorithm  Algorithm
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+type Header struct {
+	Algorithm Algorithm `json:"alg"`
+	Type      string    `json:"typ"`
+	KeyID     string    `json:"kid,omitempty"`
+}
+
+type Claims struct {
+	ID        string `json:"jti,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// KeyFunc looks up the key used to verify a token, typically by Header.KeyID.
+type KeyFunc func(header Header) (*Key, error)
+
+// Sign encodes and signs the claims with the given key.
+func Sign(claims *Claims, key *Key) (string, error) {
+	header, err := json.Marshal(
+		Header{
+			Algorithm: key.Algorithm,
+			Type:      "JWT",
+			KeyID:     key.ID,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(header) + "." + encode(payload)
+	signature, err := sign([]byte(signingInput), key)
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks the signature, expiry and audience of the token, returning
+// its claims if all of them are valid.
+func Verify(token string, audience string, keyFunc KeyFunc) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	// Header
+	var header Header
+	if err := decode(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+
+	key, err := keyFunc(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Never let the token choose the algorithm.
+	if header.Algorithm != key.Algorithm {
+		return nil, ErrInvalidAlgorithm
+	}
+
+	// Signature
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if err := verify([]byte(parts[0]+"."+parts[1]), signature, key); err != nil {
+		return nil, err
+	}
+
+	// Claims
+	var claims Claims
+	if err := decode(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt <= now {
+		return nil, ErrExpired
+	}
+
+	if claims.NotBefore > now {
+		return nil, ErrNotYetValid
+	}
+
+	if !hmac.Equal([]byte(claims.Audience), []byte(audience)) {
+		return nil, ErrInvalidAudience
+	}
+
+	return &claims, nil
+}
+
+// IsJWT reports whether the token has the shape of a compact JWT.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func sign(input []byte, key *Key) ([]byte, error) {
+	switch key.Algorithm {
+	case AlgorithmHS256:
+		if len(key.Secret) == 0 {
+			return nil, ErrMissingSigningKey
+		}
+
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case AlgorithmEdDSA:
+		if len(key.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, ErrMissingSigningKey
+		}
+
+		return ed25519.Sign(key.PrivateKey, input), nil
+	default:
+		return nil, ErrInvalidAlgorithm
+	}
+}
+
+func verify(input []byte, signature []byte, key *Key) error {
+	switch key.Algorithm {
+	case AlgorithmHS256:
+		expected, err := sign(input, key)
+		if err != nil {
+			return err
+		}
+
+		if !hmac.Equal(expected, signature) {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	case AlgorithmEdDSA:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return ErrMissingSigningKey
+		}
+
+		if !ed25519.Verify(key.PublicKey, input, signature) {
+			return ErrInvalidSignature
+		}
+
+		return nil
+	default:
+		return ErrInvalidAlgorithm
+	}
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decode(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
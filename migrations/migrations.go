@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Scope string
+
+const (
+	// ScopeBrand migrations run against every `brand_<slug>` database.
+	ScopeBrand Scope = "brand"
+	// ScopeSystem migrations run against the `system` database.
+	ScopeSystem Scope = "system"
+)
+
+// Migration is a single, reversible step. IDs are applied in lexical
+// order, so they should start with a timestamp, e.g.
+// "20240901120000_backfill_user_roles".
+type Migration struct {
+	ID          string
+	Scope       Scope
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+var (
+	registry   []Migration
+	registryMu sync.RWMutex
+)
+
+// Register adds migrations to the registry, typically from an init func.
+func Register(migrations ...Migration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, m := range migrations {
+		if m.Up == nil {
+			panic(fmt.Sprintf("[migrations.Register] %s has no Up", m.ID))
+		}
+
+		for _, existing := range registry {
+			if existing.ID == m.ID {
+				panic(fmt.Sprintf("[migrations.Register] duplicate migration %s", m.ID))
+			}
+		}
+
+		registry = append(registry, m)
+	}
+
+	slices.SortFunc(
+		registry,
+		func(a, b Migration) int {
+			return strings.Compare(a.ID, b.ID)
+		},
+	)
+}
+
+// All returns the registered migrations of the scope, in order.
+func All(scope Scope) []Migration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	var out []Migration
+	for _, m := range registry {
+		if m.Scope == scope {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// Latest returns the id of the last registered migration of the scope.
+func Latest(scope Scope) string {
+	all := All(scope)
+	if len(all) == 0 {
+		return ""
+	}
+
+	return all[len(all)-1].ID
+}
@@ -0,0 +1,369 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"slices"
+	"time"
+	"white-label-crm/database"
+	"white-label-crm/redis"
+)
+
+const (
+	ledgerCollection = "migrations"
+	lockTTL          = time.Minute
+	// The lock is renewed this often while migrating, so that a step can
+	// take longer than lockTTL.
+	lockRenewInterval = lockTTL / 3
+)
+
+var ErrNoDown = errors.New("migration cannot be rolled back")
+
+type Options struct {
+	// DryRun reports what would run without running anything.
+	DryRun bool
+	// Steps limits how many migrations are rolled back. By default the
+	// last batch is.
+	Steps int
+}
+
+type Result struct {
+	Database   string
+	Applied    []string
+	RolledBack []string
+}
+
+type StatusEntry struct {
+	ID        string     `json:"id"`
+	Applied   bool       `json:"applied"`
+	Batch     int        `json:"batch,omitempty"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+type ledgerEntry struct {
+	ID        string    `bson:"_id"`
+	Batch     int       `bson:"batch"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// Migrate applies every pending migration of the scope to db, as one batch.
+func Migrate(ctx context.Context, db *mongo.Database, scope Scope, opts Options) (*Result, error) {
+	result := &Result{Database: db.Name()}
+
+	err := withLock(
+		ctx,
+		db,
+		opts.DryRun,
+		func(ctx context.Context) error {
+			applied, err := loadLedger(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			batch := 1
+			for _, entry := range applied {
+				batch = max(batch, entry.Batch+1)
+			}
+
+			for _, m := range All(scope) {
+				if _, ok := applied[m.ID]; ok {
+					continue
+				}
+
+				result.Applied = append(result.Applied, m.ID)
+				if opts.DryRun {
+					continue
+				}
+
+				// The lock was lost, another instance may be migrating.
+				if err := context.Cause(ctx); err != nil {
+					return err
+				}
+
+				log.Printf("[migrations.Migrate] %s | Up %s\n", db.Name(), m.ID)
+				if err := m.Up(ctx, db); err != nil {
+					return fmt.Errorf("%s: %w", m.ID, err)
+				}
+
+				_, err := db.Collection(ledgerCollection).InsertOne(
+					ctx,
+					ledgerEntry{
+						ID:        m.ID,
+						Batch:     batch,
+						AppliedAt: time.Now(),
+					},
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	)
+
+	return result, err
+}
+
+// Rollback reverts the last batch of migrations applied to db, or the last
+// opts.Steps migrations.
+func Rollback(ctx context.Context, db *mongo.Database, scope Scope, opts Options) (*Result, error) {
+	result := &Result{Database: db.Name()}
+
+	err := withLock(
+		ctx,
+		db,
+		opts.DryRun,
+		func(ctx context.Context) error {
+			applied, err := loadLedger(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			lastBatch := 0
+			for _, entry := range applied {
+				lastBatch = max(lastBatch, entry.Batch)
+			}
+
+			all := All(scope)
+			for i := len(all) - 1; i >= 0; i-- {
+				m := all[i]
+				entry, ok := applied[m.ID]
+				if !ok {
+					continue
+				}
+
+				if opts.Steps > 0 && len(result.RolledBack) >= opts.Steps {
+					break
+				}
+
+				if opts.Steps == 0 && entry.Batch != lastBatch {
+					continue
+				}
+
+				if m.Down == nil {
+					return fmt.Errorf("%s: %w", m.ID, ErrNoDown)
+				}
+
+				result.RolledBack = append(result.RolledBack, m.ID)
+				if opts.DryRun {
+					continue
+				}
+
+				if err := context.Cause(ctx); err != nil {
+					return err
+				}
+
+				log.Printf("[migrations.Rollback] %s | Down %s\n", db.Name(), m.ID)
+				if err := m.Down(ctx, db); err != nil {
+					return fmt.Errorf("%s: %w", m.ID, err)
+				}
+
+				if _, err := db.Collection(ledgerCollection).DeleteOne(ctx, bson.M{"_id": m.ID}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	)
+
+	return result, err
+}
+
+// Replay runs the Up of the given migrations again on db, in order, for
+// data that was added to it without going through them, such as an import
+// from before they were applied. Only migrations db has applied are
+// replayed; the ledger is left as it is.
+func Replay(ctx context.Context, db *mongo.Database, scope Scope, ids []string, opts Options) (*Result, error) {
+	result := &Result{Database: db.Name()}
+
+	err := withLock(
+		ctx,
+		db,
+		opts.DryRun,
+		func(ctx context.Context) error {
+			applied, err := loadLedger(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			for _, m := range All(scope) {
+				if _, ok := applied[m.ID]; !ok || !slices.Contains(ids, m.ID) {
+					continue
+				}
+
+				result.Applied = append(result.Applied, m.ID)
+				if opts.DryRun {
+					continue
+				}
+
+				if err := context.Cause(ctx); err != nil {
+					return err
+				}
+
+				log.Printf("[migrations.Replay] %s | Up %s\n", db.Name(), m.ID)
+				if err := m.Up(ctx, db); err != nil {
+					return fmt.Errorf("%s: %w", m.ID, err)
+				}
+			}
+
+			return nil
+		},
+	)
+
+	return result, err
+}
+
+// Status lists every migration of the scope and whether db has it applied.
+func Status(ctx context.Context, db *mongo.Database, scope Scope) ([]StatusEntry, error) {
+	applied, err := loadLedger(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []StatusEntry
+	for _, m := range All(scope) {
+		status := StatusEntry{ID: m.ID}
+		if entry, ok := applied[m.ID]; ok {
+			status.Applied = true
+			status.Batch = entry.Batch
+			status.AppliedAt = &entry.AppliedAt
+		}
+
+		out = append(out, status)
+	}
+
+	return out, nil
+}
+
+// BrandDatabases returns the database of every brand that hasn't been
+// deleted, optionally limited to the given slugs.
+func BrandDatabases(ctx context.Context, slugs ...string) ([]*mongo.Database, error) {
+	filter := bson.M{"deletedAt": bson.M{"$exists": false}}
+	if len(slugs) > 0 {
+		filter["slug"] = bson.M{"$in": slugs}
+	}
+
+	cursor, err := database.GetSystemDb().Collection("brands").Find(
+		ctx,
+		filter,
+		options.Find().SetProjection(bson.M{"slug": 1, "databaseUri": 1, "cluster": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var brands []struct {
+		Slug        string `bson:"slug"`
+		DatabaseURI []byte `bson:"databaseUri"`
+		Cluster     string `bson:"cluster"`
+	}
+	if err := cursor.All(ctx, &brands); err != nil {
+		return nil, err
+	}
+
+	dbs := make([]*mongo.Database, len(brands))
+	for i, brand := range brands {
+		var cluster *database.Cluster
+		if len(brand.DatabaseURI) > 0 {
+			cluster = &database.Cluster{ID: brand.Cluster, URI: brand.DatabaseURI}
+		}
+
+		db, err := database.GetClusterDb(cluster, fmt.Sprintf("brand_%s", brand.Slug))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", brand.Slug, err)
+		}
+
+		dbs[i] = db
+	}
+
+	return dbs, nil
+}
+
+func loadLedger(ctx context.Context, db *mongo.Database) (map[string]ledgerEntry, error) {
+	cursor, err := db.Collection(ledgerCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ledgerEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]ledgerEntry, len(entries))
+	for _, entry := range entries {
+		applied[entry.ID] = entry
+	}
+
+	return applied, nil
+}
+
+// withLock makes sure only one instance migrates a database at a time. The
+// lock is renewed in the background while fn runs and expires on its own if
+// the instance dies. Should it be lost anyway, the ctx given to fn is
+// cancelled with redis.ErrNotHeld as its cause.
+func withLock(ctx context.Context, db *mongo.Database, dryRun bool, fn func(ctx context.Context) error) error {
+	if dryRun {
+		return fn(ctx)
+	}
+
+	lock, err := redis.Acquire(ctx, fmt.Sprintf("locks:migrations:%s", db.Name()), lockTTL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(context.Background()); err != nil {
+			log.Printf("[migrations.withLock] %v\n", err)
+		}
+	}()
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Stop renewing before the lock is released.
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+
+		renewedAt := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			err := lock.Extend(ctx, lockTTL)
+			if err == nil {
+				renewedAt = time.Now()
+				continue
+			}
+
+			log.Printf("[migrations.withLock] %s | %v\n", db.Name(), err)
+
+			// Redis may only be briefly unavailable; the lock holds until
+			// its TTL runs out.
+			if errors.Is(err, redis.ErrNotHeld) || time.Since(renewedAt) >= lockTTL {
+				cancel(redis.ErrNotHeld)
+				return
+			}
+		}
+	}()
+
+	return fn(lockCtx)
+}
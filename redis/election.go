@@ -0,0 +1,140 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Election elects one leader among the instances campaigning on the same
+// key. The leader holds a lease it renews every third of its TTL; should it
+// die, another instance takes over at most one TTL later.
+type Election struct {
+	key string
+	id  string
+	ttl time.Duration
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+// InstanceID identifies this process among the other instances.
+func InstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func NewElection(key string, id string, ttl time.Duration) *Election {
+	return &Election{
+		key: key,
+		id:  id,
+		ttl: ttl,
+	}
+}
+
+// Run campaigns until ctx is done. Whenever this instance is elected, lead
+// is called with a context that is cancelled as soon as leadership is lost;
+// it must return once that happens.
+func (e *Election) Run(ctx context.Context, lead func(ctx context.Context)) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		lock, err := AcquireAs(ctx, e.key, e.id, e.ttl)
+		if err == nil {
+			e.term(ctx, lock, ticker, lead)
+		} else if !errors.Is(err, ErrLocked) && ctx.Err() == nil {
+			log.Printf("[Election.Run] %s | %v\n", e.key, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// term leads until the lease is lost, lead returns or ctx is done.
+func (e *Election) term(ctx context.Context, lock *Lock, ticker *time.Ticker, lead func(ctx context.Context)) {
+	leadCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	e.setSince(time.Now())
+	log.Printf("[Election.term] %s | %s elected\n", e.key, e.id)
+
+	go func() {
+		defer close(done)
+		lead(leadCtx)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+		e.setSince(time.Time{})
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.release(lock)
+			return
+		case <-done:
+			e.release(lock)
+			return
+		case <-ticker.C:
+		}
+
+		// Step down on any error: the lease may run out before the next
+		// renewal succeeds, and two leaders are worse than none.
+		if err := lock.Extend(ctx, e.ttl); err != nil {
+			log.Printf("[Election.term] %s | %s stepping down | %v\n", e.key, e.id, err)
+			return
+		}
+	}
+}
+
+func (e *Election) release(lock *Lock) {
+	if err := lock.Release(context.Background()); err != nil && !errors.Is(err, ErrNotHeld) {
+		log.Printf("[Election.release] %s | %v\n", e.key, err)
+	}
+}
+
+func (e *Election) setSince(since time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.since = since
+}
+
+// ID is the identifier this instance campaigns with.
+func (e *Election) ID() string {
+	return e.id
+}
+
+// IsLeader reports whether this instance currently leads, and since when.
+func (e *Election) IsLeader() (bool, time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return !e.since.IsZero(), e.since
+}
+
+// Leader returns the id of the current leader, or "" when there's none.
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	id, err := Client.Get(ctx, e.key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+
+	return id, err
+}
@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	ErrLocked  = errors.New("lock is held by someone else")
+	ErrNotHeld = errors.New("lock is no longer held")
+)
+
+// Only delete/extend the key if it still holds our token, so an expired
+// lock that someone else has since acquired is never touched.
+var (
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+	extendScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+)
+
+type Lock struct {
+	key   string
+	token string
+}
+
+// Acquire takes a lock that expires after ttl unless it is extended.
+// ErrLocked is returned when it is already held.
+func Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	return AcquireAs(ctx, key, hex.EncodeToString(raw), ttl)
+}
+
+// AcquireAs is Acquire with a caller chosen token, e.g. an instance id.
+func AcquireAs(ctx context.Context, key string, token string, ttl time.Duration) (*Lock, error) {
+	ok, err := Client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	return &Lock{key: key, token: token}, nil
+}
+
+// Extend resets the lock's expiry, failing with ErrNotHeld if it was lost.
+func (l *Lock) Extend(ctx context.Context, ttl time.Duration) error {
+	n, err := extendScript.Run(ctx, Client, []string{l.key}, l.token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotHeld
+	}
+
+	return nil
+}
+
+func (l *Lock) Release(ctx context.Context) error {
+	return releaseScript.Run(ctx, Client, []string{l.key}, l.token).Err()
+}